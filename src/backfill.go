@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/urfave/cli"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+const DefaultBackfillWorkers = 4
+const DefaultBackfillRangeSize = 100
+const DefaultBackfillMaxInFlight = 10000
+const backfillRetries = 5
+const backfillReportInterval = 10 * time.Second
+
+type BackfillRange struct {
+	Start  uint64
+	End    uint64
+	Blocks []ChiaBlockRecord
+	Err    error
+}
+
+// fetch one height range, retrying transient rpc errors
+func fetchBackfillRange(ctx context.Context, node *FullNodeClient, job *BackfillRange) {
+	for i := 0; i < backfillRetries; i++ {
+		result, err := node.GetBlockRecords(ctx, GetBlockRecordsRequest{Start: job.Start, End: job.End})
+		job.Err = err
+		if job.Err == nil && uint64(len(result.BlockRecords)) != job.End-job.Start {
+			job.Err = fmt.Errorf("expect %d blocks, got %d", job.End-job.Start, len(result.BlockRecords))
+		}
+		if job.Err == nil {
+			job.Blocks = result.BlockRecords
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(i+1) * time.Second):
+		}
+	}
+}
+
+// sync blocks of [start, stop] with a pool of workers fetching height ranges concurrently,
+// ranges are committed strictly in height order so the aggregates and the sync height stay consistent.
+// returns the height after the last committed block, start if none was committed, and the header hash of the last one.
+func Backfill(ctx context.Context, config *Config, db *gorm.DB, node *FullNodeClient, start uint64, prevHash string, stop uint64) (uint64, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	rangeSize := config.BackfillRangeSize
+	maxRanges := config.BackfillMaxInFlight / rangeSize
+	if maxRanges < 1 {
+		maxRanges = 1
+	}
+	// tokens are taken in height order by the dispatcher and given back by the committer,
+	// so the range the committer waits for always holds a token
+	tokens := make(chan struct{}, maxRanges)
+	jobs := make(chan *BackfillRange)
+	results := make(chan *BackfillRange)
+
+	go func() {
+		defer close(jobs)
+		for s := start; s <= stop; s += rangeSize {
+			e := s + rangeSize
+			if e > stop+1 {
+				e = stop + 1
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case tokens <- struct{}{}:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- &BackfillRange{Start: s, End: e}:
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := uint(0); i < config.BackfillWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				fetchBackfillRange(ctx, node, job)
+				select {
+				case <-ctx.Done():
+					return
+				case results <- job:
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := make(map[uint64]*BackfillRange)
+	// blocks after the last transaction block of a range wait for the next range to interpolate their timestamps
+	var carry []ChiaBlockRecord
+	var prevBlock, prevTx *ChiaBlockRecord
+	next := start
+	// the height after the last committed block, start - 1 would underflow at genesis
+	synced := start
+	committed := uint64(0)
+	began := time.Now()
+	reported := began
+	for job := range results {
+		pending[job.Start] = job
+		for {
+			ready, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			if ready.Err != nil {
+				return synced, prevHash, fmt.Errorf("error fetch blocks %d-%d: %v", ready.Start, ready.End-1, ready.Err)
+			}
+			blocks := append(carry, ready.Blocks...)
+			if !BlocksLinked(prevHash, blocks) {
+				return synced, prevHash, fmt.Errorf("blocks %d-%d do not extend the synced chain", ready.Start, ready.End-1)
+			}
+			if ready.End <= stop {
+				blocks, carry = SplitAtLastTransactionBlock(blocks)
+			} else {
+				carry = nil
+			}
+			next = ready.End
+			<-tokens
+			if len(blocks) == 0 {
+				continue
+			}
+			var err error
+			prevTx, err = PrevTransactionBlock(ctx, node, db, &blocks[0], prevTx)
+			if err != nil {
+				return synced, prevHash, err
+			}
+			prevBlock, err = PrevBlock(ctx, node, db, &blocks[0], prevBlock)
+			if err != nil {
+				return synced, prevHash, err
+			}
+			err = AggregatesTransaction(db, func(tx *gorm.DB) error {
+				return ApplyBlockRecords(blocks, prevBlock, prevTx, config, tx)
+			})
+			if err != nil {
+				return synced, prevHash, fmt.Errorf("error commit blocks %d-%d: %v", blocks[0].Height, blocks[len(blocks)-1].Height, err)
+			}
+			last := blocks[len(blocks)-1]
+			synced, prevHash = last.Height+1, last.HeaderHash
+			prevBlock = &last
+			prevTx = LastTransactionBlock(blocks, prevTx)
+			committed += uint64(len(blocks))
+		}
+		if time.Since(reported) >= backfillReportInterval {
+			reported = time.Now()
+			reportBackfillProgress(synced, stop, committed, time.Since(began), len(pending))
+		}
+	}
+	if ctx.Err() != nil {
+		return synced, prevHash, ctx.Err()
+	}
+	reportBackfillProgress(synced, stop, committed, time.Since(began), len(pending))
+	return synced, prevHash, nil
+}
+
+// synced is the height after the last committed block
+func reportBackfillProgress(synced uint64, stop uint64, committed uint64, elapsed time.Duration, buffered int) {
+	rate := float64(committed) / elapsed.Seconds()
+	eta := time.Duration(0)
+	if rate > 0 && stop+1 > synced {
+		eta = time.Duration(float64(stop+1-synced)/rate) * time.Second
+	}
+	fmt.Printf("backfill at height: %d/%d, %.1f blocks/s, buffered ranges: %d, eta: %s \r\n", synced, stop, rate, buffered, eta)
+}
+
+// backfill up to height to, the peak if 0, until ctx is done. the committed batches are kept on shutdown.
+func BackfillBlocks(ctx context.Context, channel chan int, config *Config, to uint64, heartbeat *Heartbeat) {
+	db, err := GetDb(config)
+	if err != nil {
+		fmt.Printf("error open db connection: %v \r\n", err)
+		channel <- ExitFailure
+		return
+	}
+	pool, err := NewFullNodePool(config)
+	if err != nil {
+		fmt.Printf("error create rcp client: %v \r\n", err)
+		channel <- ExitFailure
+		return
+	}
+	// ranges are fetched from the healthiest full node only, failover is left to sync
+	node, err := pool.Select(ctx)
+	if err != nil {
+		fmt.Printf("error select full node: %v \r\n", err)
+		channel <- ExitFailure
+		return
+	}
+
+	blockHeight, err := GetSyncedHeight(db)
+	if err != nil {
+		fmt.Printf("error get synced height: %v \r\n", err)
+		channel <- ExitFailure
+		return
+	}
+	start := uint64(0)
+	prevHash := ""
+	if blockHeight != nil {
+		start = blockHeight.Height + 1
+		prevHash = blockHeight.HeaderHash
+	}
+	if to == 0 {
+		to, err = node.GetPeakHeight(ctx)
+		if err != nil {
+			fmt.Printf("error get peak height: %v \r\n", err)
+			channel <- ExitFailure
+			return
+		}
+	}
+	if start > to {
+		fmt.Printf("already synced to height %d \r\n", start-1)
+		channel <- ExitOK
+		return
+	}
+
+	fmt.Printf("backfill blocks %d-%d from %s with %d workers \r\n", start, to, node.Name(), config.BackfillWorkers)
+	heartbeat.Ready(fmt.Sprintf("backfilling blocks %d-%d", start, to))
+	synced, _, err := Backfill(ctx, config, db, node, start, prevHash, to)
+	if err != nil && ctx.Err() != nil {
+		fmt.Printf("backfill interrupted at height %d, run backfill again to resume \r\n", synced)
+		channel <- ExitOK
+		return
+	}
+	if err != nil {
+		fmt.Printf("backfill stopped at height %d: %v \r\n", synced, err)
+		channel <- ExitFailure
+		return
+	}
+	fmt.Printf("backfill done at height %d \r\n", to)
+	channel <- ExitOK
+}
+
+func BackfillAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb|NeedFullNode)
+	if err != nil {
+		return err
+	}
+	if ctx.IsSet("workers") {
+		config.BackfillWorkers = ctx.Uint("workers")
+	}
+	if ctx.IsSet("range-size") {
+		config.BackfillRangeSize = ctx.Uint64("range-size")
+	}
+	if ctx.IsSet("max-in-flight") {
+		config.BackfillMaxInFlight = ctx.Uint64("max-in-flight")
+	}
+	if config.BackfillWorkers == 0 || config.BackfillRangeSize == 0 {
+		return fmt.Errorf("error config: workers and range size must be greater than 0")
+	}
+
+	return RunService("backfill", func(runCtx context.Context, channel chan int, heartbeat *Heartbeat) {
+		BackfillBlocks(runCtx, channel, config, ctx.Uint64("to"), heartbeat)
+	})
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
-	"errors"
+	"fmt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"math"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -17,76 +20,216 @@ const SecondsPerBlock = (24 * 3600) / DailyBlocks
 
 type ChiaTotalFarmerBlocks struct {
 	ID            uint64 `gorm:"primaryKey;<-:false" json:"id"`
-	FarmerAddress string `gorm:"type:varchar(256);not null;index:idx_tfb_farmer_address" json:"farmer_address"`
+	FarmerAddress string `gorm:"type:varchar(256);not null;uniqueIndex:uk_tfb_farmer_address" json:"farmer_address"`
 	BlockCount    uint64 `gorm:"type:bigint(20);not null;"`
 }
 
 type ChiaDailyFarmerBlocks struct {
 	ID            uint64 `gorm:"primaryKey;<-:false" json:"id"`
-	FarmerAddress string `gorm:"type:varchar(256);not null;index:idx_dfb_farmer_address" json:"farmer_address"`
+	FarmerAddress string `gorm:"type:varchar(256);not null;uniqueIndex:uk_dfb_farmer_address_day_tz,priority:1" json:"farmer_address"`
 	BlockCount    uint64 `gorm:"type:bigint(20);not null;"`
-	Day           string `gorm:"type:date;not null;index:idx_dfb_day"`
+	Day           string `gorm:"type:date;not null;index:idx_dfb_day;uniqueIndex:uk_dfb_farmer_address_day_tz,priority:2"`
+	Timezone      string `gorm:"type:varchar(64);not null;default:Local;uniqueIndex:uk_dfb_farmer_address_day_tz,priority:3" json:"timezone"`
 }
 
+// a named sync cursor, the height and header hash of the last block processed by a pipeline
 type ChiaBlockSyncHeight struct {
-	ID     uint64 `gorm:"primaryKey;<-:false" json:"id"`
-	Height uint64 `gorm:"type:bigint(20);not null;default:0" json:"height"`
-}
-
-func IncreaseTotalBlock(farmerAddress string, db *gorm.DB) error {
-	var totalBlock ChiaTotalFarmerBlocks
-	r := db.Where("farmer_address = ?", farmerAddress).Take(&totalBlock)
-	if r.Error == nil {
-		r = db.Model(totalBlock).Update("block_count", gorm.Expr("block_count + ?", 1))
-		return r.Error
-	} else if errors.Is(r.Error, gorm.ErrRecordNotFound) {
-		r = db.Create(&ChiaTotalFarmerBlocks{
-			BlockCount: 1,
-			FarmerAddress: farmerAddress,
-		})
-		return r.Error
-	} else {
-		return r.Error
+	ID         uint64    `gorm:"primaryKey;<-:false" json:"id"`
+	Name       string    `gorm:"type:varchar(64);not null;default:blocks;uniqueIndex:uk_bsh_name" json:"name"`
+	Height     uint64    `gorm:"type:bigint(20);not null;default:0" json:"height"`
+	HeaderHash string    `gorm:"type:varchar(256);not null;default:''" json:"header_hash"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type FarmerPeriod struct {
+	Granularity   *Granularity
+	Timezone      string
+	FarmerAddress string
+	Period        string
+}
+
+// won blocks counted by farmer, and by farmer and period of every granularity in every reporting timezone
+type FarmerBlockCounts struct {
+	Timezones []ReportTimezone
+	Total     map[string]uint64
+	Periods   map[FarmerPeriod]uint64
+}
+
+func NewFarmerBlockCounts(timezones []ReportTimezone) *FarmerBlockCounts {
+	return &FarmerBlockCounts{
+		Timezones: timezones,
+		Total:     make(map[string]uint64),
+		Periods:   make(map[FarmerPeriod]uint64),
 	}
 }
 
-// estimate timestamp base on block height
-func HeightToTimestamp(height uint64) uint64 {
-	return uint64(math.Round(SecondsPerBlock* float64(height))) + FirstBlockTimestamp
+func (c *FarmerBlockCounts) Add(farmerAddress string, timestamp uint64) {
+	c.Total[farmerAddress]++
+	c.AddPeriods(farmerAddress, timestamp)
 }
 
-func IncreaseDailyBlock(farmerAddress string,timestamp uint64, db *gorm.DB) error {
-	timeStr := time.Unix(int64(timestamp), 0).Format("2006-01-02") //设置时间戳 使用模板格式化为日期字符串
+// count the block for its periods only, used when a block moves to another time
+func (c *FarmerBlockCounts) AddPeriods(farmerAddress string, timestamp uint64) {
+	for _, granularity := range Granularities {
+		for _, timezone := range c.Timezones {
+			c.Periods[FarmerPeriod{
+				Granularity:   granularity,
+				Timezone:      timezone.Name,
+				FarmerAddress: farmerAddress,
+				Period:        granularity.Period(timestamp, timezone.Location),
+			}]++
+		}
+	}
+}
+
+func (c *FarmerBlockCounts) TotalRows() []ChiaTotalFarmerBlocks {
+	rows := make([]ChiaTotalFarmerBlocks, 0, len(c.Total))
+	for farmerAddress, count := range c.Total {
+		rows = append(rows, ChiaTotalFarmerBlocks{FarmerAddress: farmerAddress, BlockCount: count})
+	}
+	// a stable order makes concurrent upserts lock rows in the same order
+	sort.Slice(rows, func(i, j int) bool { return rows[i].FarmerAddress < rows[j].FarmerAddress })
+	return rows
+}
 
-	var dailyBlock ChiaDailyFarmerBlocks
-	r := db.Where("farmer_address = ? and day = ?", farmerAddress, timeStr).Take(&dailyBlock)
-	if r.Error == nil {
-		r = db.Model(dailyBlock).Update("block_count", gorm.Expr("block_count + ?", 1))
-		return r.Error
-	} else if errors.Is(r.Error, gorm.ErrRecordNotFound) {
-		r := db.Create(&ChiaDailyFarmerBlocks{
-			BlockCount: 1,
-			FarmerAddress: farmerAddress,
-			Day:timeStr,
+// rows of the granularity's table, sorted by farmer, period and timezone
+func (c *FarmerBlockCounts) PeriodRows(granularity *Granularity) []map[string]interface{} {
+	var keys []FarmerPeriod
+	for key := range c.Periods {
+		if key.Granularity == granularity {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].FarmerAddress != keys[j].FarmerAddress {
+			return keys[i].FarmerAddress < keys[j].FarmerAddress
+		}
+		if keys[i].Period != keys[j].Period {
+			return keys[i].Period < keys[j].Period
+		}
+		return keys[i].Timezone < keys[j].Timezone
+	})
+	rows := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		rows = append(rows, map[string]interface{}{
+			"farmer_address":   key.FarmerAddress,
+			granularity.Column: key.Period,
+			"timezone":         key.Timezone,
+			"block_count":      c.Periods[key],
 		})
-		return r.Error
-	} else {
-		return r.Error
 	}
+	return rows
+}
+
+var increaseBlockCount = clause.OnConflict{
+	DoUpdates: clause.Assignments(map[string]interface{}{"block_count": gorm.Expr("block_count + VALUES(block_count)")}),
+}
+
+// add the counts to the aggregates with one INSERT ... ON DUPLICATE KEY UPDATE per table
+func UpsertFarmerBlocks(counts *FarmerBlockCounts, db *gorm.DB) error {
+	if len(counts.Total) > 0 {
+		totalRows := counts.TotalRows()
+		r := db.Clauses(increaseBlockCount).Create(&totalRows)
+		if r.Error != nil {
+			return fmt.Errorf("error upsert total blocks: %v", r.Error)
+		}
+	}
+	for _, granularity := range Granularities {
+		rows := counts.PeriodRows(granularity)
+		if len(rows) == 0 {
+			continue
+		}
+		r := db.Model(granularity.Model).Clauses(increaseBlockCount).Create(rows)
+		if r.Error != nil {
+			return fmt.Errorf("error upsert %s blocks: %v", granularity.Name, r.Error)
+		}
+	}
+	return nil
+}
+
+// subtract the counts from the aggregates, used when blocks are rolled back
+func SubtractFarmerBlocks(counts *FarmerBlockCounts, db *gorm.DB) error {
+	for _, row := range counts.TotalRows() {
+		r := db.Model(&ChiaTotalFarmerBlocks{}).
+			Where("farmer_address = ?", row.FarmerAddress).
+			Update("block_count", gorm.Expr("GREATEST(block_count, ?) - ?", row.BlockCount, row.BlockCount))
+		if r.Error != nil {
+			return fmt.Errorf("error decrease total blocks: %v", r.Error)
+		}
+	}
+	for _, granularity := range Granularities {
+		for _, row := range counts.PeriodRows(granularity) {
+			count := row["block_count"]
+			r := db.Model(granularity.Model).
+				Where(fmt.Sprintf("farmer_address = ? and %s = ? and timezone = ?", granularity.Column),
+					row["farmer_address"], row[granularity.Column], row["timezone"]).
+				Update("block_count", gorm.Expr("GREATEST(block_count, ?) - ?", count, count))
+			if r.Error != nil {
+				return fmt.Errorf("error decrease %s blocks: %v", granularity.Name, r.Error)
+			}
+		}
+	}
+	return nil
 }
 
-func LogSyncHeight(height uint64, db *gorm.DB) error {
-	blockHeight, err := GetSyncedHeight(db)
+// merge duplicated aggregate rows so the unique keys on farmer_address and (farmer_address, day) can be created
+func MergeDuplicateFarmerBlocks(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if migrator.HasTable(&ChiaTotalFarmerBlocks{}) && !migrator.HasIndex(&ChiaTotalFarmerBlocks{}, "uk_tfb_farmer_address") {
+		err := mergeDuplicateRows(db, &ChiaTotalFarmerBlocks{}, []string{"farmer_address"}, "idx_tfb_farmer_address")
+		if err != nil {
+			return err
+		}
+	}
+	if migrator.HasTable(&ChiaDailyFarmerBlocks{}) && !migrator.HasIndex(&ChiaDailyFarmerBlocks{}, "uk_dfb_farmer_address_day") &&
+		!migrator.HasIndex(&ChiaDailyFarmerBlocks{}, "uk_dfb_farmer_address_day_tz") {
+		err := mergeDuplicateRows(db, &ChiaDailyFarmerBlocks{}, []string{"farmer_address", "day"}, "idx_dfb_farmer_address")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keep the row with the smallest id of each key holding the sum of block counts, delete the others
+func mergeDuplicateRows(db *gorm.DB, model interface{}, keys []string, obsoleteIndex string) error {
+	table, err := TableName(db, model)
 	if err != nil {
 		return err
 	}
-	if blockHeight == nil {
-		r := db.Create(&ChiaBlockSyncHeight{
-			Height: height,
-		})
-		return r.Error
-	} else {
-		r := db.Model(blockHeight).Update("height", height)
-		return r.Error
+	key := strings.Join(keys, ", ")
+	on := ""
+	for _, column := range keys {
+		on += fmt.Sprintf(" AND t.%s = d.%s", column, column)
 	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		duplicates := fmt.Sprintf("SELECT MIN(id) AS id, %s, SUM(block_count) AS block_count FROM `%s` GROUP BY %s HAVING COUNT(*) > 1", key, table, key)
+		r := tx.Exec(fmt.Sprintf("UPDATE `%s` t JOIN (%s) d ON t.id = d.id SET t.block_count = d.block_count", table, duplicates))
+		if r.Error != nil {
+			return fmt.Errorf("error merge duplicated rows of %s: %v", table, r.Error)
+		}
+		r = tx.Exec(fmt.Sprintf("DELETE t FROM `%s` t JOIN (%s) d ON t.id <> d.id%s", table, duplicates, on))
+		if r.Error != nil {
+			return fmt.Errorf("error delete duplicated rows of %s: %v", table, r.Error)
+		}
+		if r.RowsAffected > 0 {
+			fmt.Printf("merged %d duplicated rows of %s \r\n", r.RowsAffected, table)
+		}
+		if tx.Migrator().HasIndex(model, obsoleteIndex) {
+			err := tx.Migrator().DropIndex(model, obsoleteIndex)
+			if err != nil {
+				return fmt.Errorf("error drop index %s: %v", obsoleteIndex, err)
+			}
+		}
+		return nil
+	})
+}
+
+// estimate timestamp base on block height
+func HeightToTimestamp(height uint64) uint64 {
+	return uint64(math.Round(SecondsPerBlock* float64(height))) + FirstBlockTimestamp
+}
+
+func LogSyncHeight(height uint64, headerHash string, db *gorm.DB) error {
+	return SetCursor(db, CursorBlocks, height, headerHash)
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"os"
+	"testing"
+	"time"
+)
+
+// the mysql database of the tests which need one, they are skipped when it is not set
+const testDsnEnv = "CHIA_REPORTER_TEST_DSN"
+
+var errTestRollback = errors.New("rollback test transaction")
+
+func testDb(tb testing.TB) (*gorm.DB, *Config) {
+	dsn := os.Getenv(testDsnEnv)
+	if dsn == "" {
+		tb.Skipf("%s is not set", testDsnEnv)
+	}
+	timezones, err := LoadReportTimezones(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	config := &Config{Dsn: dsn, ReportTimezones: timezones}
+	db, err := GetDb(config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return db, config
+}
+
+// run f in a transaction which is rolled back afterwards
+func rollback(tb testing.TB, db *gorm.DB, f func(tx *gorm.DB) error) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := f(tx)
+		if err != nil {
+			return err
+		}
+		return errTestRollback
+	})
+	if !errors.Is(err, errTestRollback) {
+		tb.Fatal(err)
+	}
+}
+
+// batches of synthetic won blocks spread over 500 farmers and the days of the chain, applied by apply in a transaction
+// which is rolled back afterwards
+func benchAggregates(b *testing.B, apply func(farmers []string, timestamps []uint64, config *Config, tx *gorm.DB) error) {
+	db, config := testDb(b)
+	const batch, farmers = 100, 500
+	var elapsed time.Duration
+	rollback(b, db, func(tx *gorm.DB) error {
+		b.ResetTimer()
+		began := time.Now()
+		for i := 0; i < b.N; i++ {
+			farmerAddresses, timestamps := make([]string, batch), make([]uint64, batch)
+			for j := 0; j < batch; j++ {
+				height := uint64(i*batch + j)
+				farmerAddresses[j] = fmt.Sprintf("bench-farmer-%d", (height*7919)%farmers)
+				timestamps[j] = HeightToTimestamp(height)
+			}
+			err := apply(farmerAddresses, timestamps, config, tx)
+			if err != nil {
+				return err
+			}
+		}
+		b.StopTimer()
+		elapsed = time.Since(began)
+		return nil
+	})
+	b.ReportMetric(float64(b.N*batch)/elapsed.Seconds(), "blocks/s")
+}
+
+// one upsert per batch
+func BenchmarkAggregateUpserts(b *testing.B) {
+	benchAggregates(b, func(farmers []string, timestamps []uint64, config *Config, tx *gorm.DB) error {
+		counts := NewFarmerBlockCounts(config.ReportTimezones)
+		for index, farmer := range farmers {
+			counts.Add(farmer, timestamps[index])
+		}
+		return UpsertFarmerBlocks(counts, tx)
+	})
+}
+
+// the read-then-update of the total and daily aggregates per block, which the batch upserts replaced
+func BenchmarkAggregatePerBlock(b *testing.B) {
+	benchAggregates(b, func(farmers []string, timestamps []uint64, config *Config, tx *gorm.DB) error {
+		for index, farmer := range farmers {
+			err := increaseBlockPerBlock(farmer, timestamps[index], config.ReportTimezones[0], tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// the per-block path of older versions: read the total and daily rows of the farmer, then update or create them
+func increaseBlockPerBlock(farmerAddress string, timestamp uint64, timezone ReportTimezone, db *gorm.DB) error {
+	var totalBlock ChiaTotalFarmerBlocks
+	r := db.Where("farmer_address = ?", farmerAddress).Take(&totalBlock)
+	if r.Error == nil {
+		r = db.Model(totalBlock).Update("block_count", gorm.Expr("block_count + ?", 1))
+	} else if errors.Is(r.Error, gorm.ErrRecordNotFound) {
+		r = db.Create(&ChiaTotalFarmerBlocks{BlockCount: 1, FarmerAddress: farmerAddress})
+	}
+	if r.Error != nil {
+		return r.Error
+	}
+
+	day := time.Unix(int64(timestamp), 0).In(timezone.Location).Format("2006-01-02")
+	var dailyBlock ChiaDailyFarmerBlocks
+	r = db.Where("farmer_address = ? and day = ? and timezone = ?", farmerAddress, day, timezone.Name).Take(&dailyBlock)
+	if r.Error == nil {
+		r = db.Model(dailyBlock).Update("block_count", gorm.Expr("block_count + ?", 1))
+	} else if errors.Is(r.Error, gorm.ErrRecordNotFound) {
+		r = db.Create(&ChiaDailyFarmerBlocks{BlockCount: 1, FarmerAddress: farmerAddress, Day: day, Timezone: timezone.Name})
+	}
+	return r.Error
+}
@@ -1,10 +1,5 @@
 package main
 
-import (
-	"fmt"
-	"net/http"
-)
-
 type ChiaBlockRecord struct {
 	ID                         uint64 `gorm:"primaryKey;<-:false" json:"id"`
 	ChallengeBlockInfoHash     string `gorm:"type:varchar(256);not null;default:unknown" json:"challenge_block_info_hash"`
@@ -12,7 +7,7 @@ type ChiaBlockRecord struct {
 	FarmerPuzzleHash           string `gorm:"type:varchar(256);not null;default:unknown;idx_bc_farmer_puzzle_hash" json:"farmer_puzzle_hash"`
 	Fees                       uint64 `gorm:"type:bigint(20);not null;default:0" json:"fees"`
 	HeaderHash                 string `gorm:"type:varchar(256);not null;default:unknown;index:idx_bc_header_hash" json:"header_hash"`
-	Height                     uint64 `gorm:"type:bigint(20);not null;default:0;index:idx_bc_height" json:"height"`
+	Height                     uint64 `gorm:"type:bigint(20);not null;default:0;uniqueIndex:uk_bc_height" json:"height"`
 	Overflow                   bool   `gorm:"type:bool;not null;default:false" json:"overflow"`
 	PoolPuzzleHash             string `gorm:"type:varchar(256);not null;default:unknown" json:"pool_puzzle_hash"`
 	PrevHash                   string `gorm:"type:varchar(256);not null;default:unknown" json:"prev_hash"`
@@ -30,13 +25,7 @@ type ChiaBlockRecord struct {
 	IsTransactionBlock         bool   `gorm:"type:bool;not null;default:false;index:idx_bc_farmer_address_itb" json:"is_transaction_block"`
 }
 
-type GetBlocksResponse struct {
+type GetBlockRecordsResponse struct {
+	RpcResponse
 	BlockRecords []ChiaBlockRecord `json:"block_records"`
 }
-
-func GetBlockRecords(client *http.Client, host string, port uint, start uint64, end uint64, result *GetBlocksResponse) error {
-	url := fmt.Sprintf("https://%s:%d/get_block_records?start=%d&end=%d", host, port, start, end)
-	data := fmt.Sprintf(`{"start": %d, "end": %d}`, start, end)
-	fmt.Printf("reading blocks... start: %d, end: %d \r\n", start, end)
-	return RpcFetch(client, url, data, result)
-}
\ No newline at end of file
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"gorm.io/gorm"
+	"os"
+	"time"
+)
+
+const DefaultBlockchainStateInterval = 60
+
+type BlockchainPeak struct {
+	HeaderHash string `json:"header_hash"`
+	Height     uint64 `json:"height"`
+	Timestamp  uint64 `json:"timestamp"`
+}
+
+type BlockchainSync struct {
+	SyncMode           bool   `json:"sync_mode"`
+	Synced             bool   `json:"synced"`
+	SyncProgressHeight uint64 `json:"sync_progress_height"`
+	SyncTipHeight      uint64 `json:"sync_tip_height"`
+}
+
+type BlockchainState struct {
+	Peak         *BlockchainPeak `json:"peak"`
+	Sync         BlockchainSync  `json:"sync"`
+	Space        float64         `json:"space"`
+	Difficulty   uint64          `json:"difficulty"`
+	SubSlotIters uint64          `json:"sub_slot_iters"`
+	MempoolSize  uint64          `json:"mempool_size"`
+}
+
+type BlockchainStateResponse struct {
+	RpcResponse
+	BlockchainState BlockchainState `json:"blockchain_state"`
+}
+
+// snapshot of the network state reported by the full node
+type ChiaBlockchainState struct {
+	ID                 uint64    `gorm:"primaryKey;<-:false" json:"id"`
+	PeakHeight         uint64    `gorm:"type:bigint(20);not null;default:0" json:"peak_height"`
+	PeakHeaderHash     string    `gorm:"type:varchar(256);not null;default:''" json:"peak_header_hash"`
+	Space              float64   `gorm:"type:double;not null;default:0" json:"space"`
+	Difficulty         uint64    `gorm:"type:bigint(20);not null;default:0" json:"difficulty"`
+	SubSlotIters       uint64    `gorm:"type:bigint(20);not null;default:0" json:"sub_slot_iters"`
+	MempoolSize        uint64    `gorm:"type:bigint(20);not null;default:0" json:"mempool_size"`
+	Synced             bool      `gorm:"type:bool;not null;default:false" json:"synced"`
+	SyncMode           bool      `gorm:"type:bool;not null;default:false" json:"sync_mode"`
+	SyncProgressHeight uint64    `gorm:"type:bigint(20);not null;default:0" json:"sync_progress_height"`
+	SyncTipHeight      uint64    `gorm:"type:bigint(20);not null;default:0" json:"sync_tip_height"`
+	CreatedAt          time.Time `gorm:"index:idx_bs_created_at" json:"created_at"`
+}
+
+func NewChiaBlockchainState(state *BlockchainState) *ChiaBlockchainState {
+	snapshot := &ChiaBlockchainState{
+		Space:              state.Space,
+		Difficulty:         state.Difficulty,
+		SubSlotIters:       state.SubSlotIters,
+		MempoolSize:        state.MempoolSize,
+		Synced:             state.Sync.Synced,
+		SyncMode:           state.Sync.SyncMode,
+		SyncProgressHeight: state.Sync.SyncProgressHeight,
+		SyncTipHeight:      state.Sync.SyncTipHeight,
+	}
+	if state.Peak != nil {
+		snapshot.PeakHeight = state.Peak.Height
+		snapshot.PeakHeaderHash = state.Peak.HeaderHash
+	}
+	return snapshot
+}
+
+// snapshots taken in [from, to], ordered by time
+func QueryBlockchainStates(db *gorm.DB, from time.Time, to time.Time) ([]ChiaBlockchainState, error) {
+	var states []ChiaBlockchainState
+	r := db.Where("created_at >= ? and created_at <= ?", from, to).Order("created_at").Find(&states)
+	if r.Error != nil {
+		return nil, fmt.Errorf("error query blockchain states: %v", r.Error)
+	}
+	return states, nil
+}
+
+// record a snapshot every blockchain_state_interval until ctx is done
+func CollectBlockchainState(ctx context.Context, channel chan int, runtime *Runtime, heartbeat *Heartbeat) {
+	config := runtime.Config
+	db, err := runtime.Db()
+	if err != nil {
+		fmt.Printf("error open db connection: %v \r\n", err)
+		channel <- ExitFailure
+		return
+	}
+	pool, err := runtime.FullNodePool()
+	if err != nil {
+		fmt.Printf("error create rcp client: %v \r\n", err)
+		channel <- ExitFailure
+		return
+	}
+
+	interval := time.Duration(config.BlockchainStateInterval) * time.Second
+	heartbeat.Ready("collecting blockchain state")
+	for {
+		heartbeat.Beat(interval)
+		var result *BlockchainStateResponse
+		node, err := pool.Node(ctx)
+		if err == nil {
+			result, err = node.GetBlockchainState(ctx)
+			if err != nil && ctx.Err() == nil {
+				pool.Failover(ctx)
+			}
+		}
+		if err != nil {
+			// a snapshot interrupted by the shutdown is not an error
+			if ctx.Err() == nil {
+				fmt.Printf("error get blockchain state: %v \r\n", err)
+			}
+		} else {
+			r := db.Create(NewChiaBlockchainState(&result.BlockchainState))
+			if r.Error != nil {
+				fmt.Printf("error save blockchain state: %v \r\n", r.Error)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			channel <- ExitOK
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func CollectStateAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb|NeedFullNode)
+	if err != nil {
+		return err
+	}
+
+	return RunService("collect", func(runCtx context.Context, channel chan int, heartbeat *Heartbeat) {
+		CollectBlockchainState(runCtx, channel, NewRuntime(config), heartbeat)
+	})
+}
+
+// parse a time flag as yyyy-mm-dd or yyyy-mm-dd hh:mm:ss in local time
+func ParseTimeFlag(value string, defaultValue time.Time) (time.Time, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s, expect yyyy-mm-dd or yyyy-mm-dd hh:mm:ss", value)
+}
+
+func QueryStateAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb)
+	if err != nil {
+		return err
+	}
+	to, err := ParseTimeFlag(ctx.String("to"), time.Now())
+	if err != nil {
+		return err
+	}
+	from, err := ParseTimeFlag(ctx.String("from"), to.Add(-24*time.Hour))
+	if err != nil {
+		return err
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+
+	states, err := QueryBlockchainStates(db, from, to)
+	if err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(states)
+	}
+	for _, state := range states {
+		fmt.Printf("%s height: %d, space: %.3f EiB, difficulty: %d, sub slot iters: %d, mempool: %d, synced: %t \r\n",
+			state.CreatedAt.Format("2006-01-02 15:04:05"), state.PeakHeight, state.Space/(1<<60),
+			state.Difficulty, state.SubSlotIters, state.MempoolSize, state.Synced)
+	}
+	return nil
+}
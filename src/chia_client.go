@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const DefaultFarmerRpcPort = 8559
+
+// success and error fields every chia rpc reply carries, embedded in the response structs
+type RpcResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+}
+
+func (r *RpcResponse) rpcResponse() *RpcResponse {
+	return r
+}
+
+type rpcEnvelope interface {
+	rpcResponse() *RpcResponse
+}
+
+// a reply of a chia service with success false
+type ChiaRpcError struct {
+	Url     string
+	Message string
+}
+
+func (e *ChiaRpcError) Error() string {
+	return fmt.Sprintf("chia rpc error, url: %s, err: %s", e.Url, e.Message)
+}
+
+// a call the service did not answer, the connection failed or the call timed out
+type RpcConnError struct {
+	Url string
+	Err error
+}
+
+func (e *RpcConnError) Error() string {
+	return fmt.Sprintf("error on rpc fetch, url: %s, err: %v", e.Url, e.Err)
+}
+
+func (e *RpcConnError) Unwrap() error {
+	return e.Err
+}
+
+// a reply with a http status other than 200, Body is the beginning of the reply
+type RpcStatusError struct {
+	Url        string
+	StatusCode int
+	Body       string
+}
+
+func (e *RpcStatusError) Error() string {
+	return fmt.Sprintf("error on rpc fetch, url: %s, status: %d, body: %s", e.Url, e.StatusCode, e.Body)
+}
+
+// one chia service on one host, requests are sent with the rpc client of its tls identity.
+// without a policy calls have the default timeout and are not retried, without a breaker they are always sent.
+type RpcEndpoint struct {
+	Host    string
+	Port    uint
+	Client  *http.Client
+	Policy  *RpcPolicy
+	Breaker *CircuitBreaker
+}
+
+func (e *RpcEndpoint) Name() string {
+	return fmt.Sprintf("%s:%d", e.Host, e.Port)
+}
+
+// post the json of request to an endpoint of the service and decode the reply into response.
+// idempotent endpoints are retried with a jittered backoff while the service is down.
+func (e *RpcEndpoint) Call(ctx context.Context, endpoint string, request interface{}, response rpcEnvelope) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("error encode %s request: %v", endpoint, err)
+	}
+	url := fmt.Sprintf("https://%s:%d/%s", e.Host, e.Port, endpoint)
+	attempts := 1
+	if e.Policy != nil && idempotentEndpoints[endpoint] {
+		attempts += e.Policy.Retries
+	}
+	backoff := &Backoff{Min: rpcRetryBackoffMin, Max: rpcRetryBackoffMax}
+	for attempt := 1; ; attempt++ {
+		err = e.fetch(ctx, endpoint, url, string(data), response)
+		if err == nil || attempt >= attempts || ctx.Err() != nil || !IsServiceDown(err) {
+			return err
+		}
+		delay := Jitter(backoff.Next())
+		fmt.Printf("retry %s of %s in %s, attempt %d/%d: %v \r\n", endpoint, e.Name(), delay, attempt+1, attempts, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+type FullNodeClient struct {
+	RpcEndpoint
+}
+
+type WalletClient struct {
+	RpcEndpoint
+}
+
+type HarvesterClient struct {
+	RpcEndpoint
+}
+
+type FarmerClient struct {
+	RpcEndpoint
+}
+
+// clients of the chia services a farm runs, harvesters often run on other machines
+type ChiaClient struct {
+	FullNode   *FullNodeClient
+	Wallet     *WalletClient
+	Harvesters []*HarvesterClient
+	Farmer     *FarmerClient
+}
+
+// the endpoint of a service with the rpc client of its tls identity created by newClient
+func newServiceEndpoint(config *Config, service ServiceConfig, newClient func(certFile string, keyFile string, caFile string) (*http.Client, error)) (RpcEndpoint, error) {
+	client, err := newClient(service.PrivateCert, service.PrivateKey, service.CaCert)
+	if err != nil {
+		return RpcEndpoint{}, fmt.Errorf("error create rpc client of %s:%d: %v", service.Host, service.Port, err)
+	}
+	return NewRpcEndpoint(config, service.Host, service.Port, client), nil
+}
+
+// clients of the services of config with the rpc clients created by newClient, the full node is the first of full_nodes.
+// the client of a service which is not configured is nil, commands validate the services they use.
+func NewChiaClient(config *Config, newClient func(certFile string, keyFile string, caFile string) (*http.Client, error)) (*ChiaClient, error) {
+	client := &ChiaClient{}
+	if len(config.FullNodes) > 0 && config.validateService(&config.FullNodes[0], "full node") == nil {
+		endpoint, err := newServiceEndpoint(config, config.FullNodes[0], newClient)
+		if err != nil {
+			return nil, err
+		}
+		client.FullNode = &FullNodeClient{endpoint}
+	}
+	if config.validateService(&config.Wallet, "wallet") == nil {
+		endpoint, err := newServiceEndpoint(config, config.Wallet, newClient)
+		if err != nil {
+			return nil, err
+		}
+		client.Wallet = &WalletClient{endpoint}
+	}
+	for _, harvester := range config.Harvesters {
+		if config.validateService(&harvester, "harvester") != nil {
+			continue
+		}
+		endpoint, err := newServiceEndpoint(config, harvester, newClient)
+		if err != nil {
+			return nil, err
+		}
+		client.Harvesters = append(client.Harvesters, &HarvesterClient{endpoint})
+	}
+	if config.validateService(&config.Farmer, "farmer") == nil {
+		endpoint, err := newServiceEndpoint(config, config.Farmer, newClient)
+		if err != nil {
+			return nil, err
+		}
+		client.Farmer = &FarmerClient{endpoint}
+	}
+	return client, nil
+}
+
+type GetBlockRecordsRequest struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// block records of heights [Start, End)
+func (c *FullNodeClient) GetBlockRecords(ctx context.Context, request GetBlockRecordsRequest) (*GetBlockRecordsResponse, error) {
+	fmt.Printf("reading blocks... start: %d, end: %d \r\n", request.Start, request.End)
+	response := &GetBlockRecordsResponse{}
+	err := c.Call(ctx, "get_block_records", request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+type GetBlocksRequest struct {
+	Start             uint64 `json:"start"`
+	End               uint64 `json:"end"`
+	ExcludeHeaderHash bool   `json:"exclude_header_hash"`
+}
+
+// full blocks of heights [Start, End)
+func (c *FullNodeClient) GetBlocks(ctx context.Context, request GetBlocksRequest) (*GetBlocksResponse, error) {
+	response := &GetBlocksResponse{}
+	err := c.Call(ctx, "get_blocks", request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+type GetAdditionsAndRemovalsRequest struct {
+	HeaderHash string `json:"header_hash"`
+}
+
+// coins created and spent by a transaction block, the additions include its reward coins
+func (c *FullNodeClient) GetAdditionsAndRemovals(ctx context.Context, request GetAdditionsAndRemovalsRequest) (*GetAdditionsAndRemovalsResponse, error) {
+	response := &GetAdditionsAndRemovalsResponse{}
+	err := c.Call(ctx, "get_additions_and_removals", request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *FullNodeClient) GetBlockchainState(ctx context.Context) (*BlockchainStateResponse, error) {
+	response := &BlockchainStateResponse{}
+	err := c.Call(ctx, "get_blockchain_state", struct{}{}, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// height of the full node's peak
+func (c *FullNodeClient) GetPeakHeight(ctx context.Context) (uint64, error) {
+	response, err := c.GetBlockchainState(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if response.BlockchainState.Peak == nil {
+		return 0, fmt.Errorf("full node has no peak")
+	}
+	return response.BlockchainState.Peak.Height, nil
+}
+
+func (c *WalletClient) GetWallets(ctx context.Context) (*WalletResponse, error) {
+	response := &WalletResponse{}
+	err := c.Call(ctx, "get_wallets", struct{}{}, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+type GetWalletBalanceRequest struct {
+	WalletId uint `json:"wallet_id"`
+}
+
+func (c *WalletClient) GetWalletBalance(ctx context.Context, request GetWalletBalanceRequest) (*WalletBalanceResponse, error) {
+	response := &WalletBalanceResponse{}
+	err := c.Call(ctx, "get_wallet_balance", request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *WalletClient) GetFarmedAmount(ctx context.Context) (*FarmedAmount, error) {
+	response := &FarmedAmount{}
+	err := c.Call(ctx, "get_farmed_amount", struct{}{}, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+type GetNextAddressRequest struct {
+	WalletId   uint `json:"wallet_id"`
+	NewAddress bool `json:"new_address"`
+}
+
+func (c *WalletClient) GetNextAddress(ctx context.Context, request GetNextAddressRequest) (*WalletAddress, error) {
+	response := &WalletAddress{}
+	err := c.Call(ctx, "get_next_address", request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *HarvesterClient) GetPlots(ctx context.Context) (*PlotsResponse, error) {
+	response := &PlotsResponse{}
+	err := c.Call(ctx, "get_plots", struct{}{}, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+type GetRewardTargetsRequest struct {
+	SearchForPrivateKey bool `json:"search_for_private_key"`
+}
+
+type RewardTargetsResponse struct {
+	RpcResponse
+	FarmerTarget string `json:"farmer_target"`
+	PoolTarget   string `json:"pool_target"`
+	HaveFarmerSk bool   `json:"have_farmer_sk"`
+	HavePoolSk   bool   `json:"have_pool_sk"`
+}
+
+// addresses the farmer and pool rewards of won blocks are paid to
+func (c *FarmerClient) GetRewardTargets(ctx context.Context, request GetRewardTargetsRequest) (*RewardTargetsResponse, error) {
+	response := &RewardTargetsResponse{}
+	err := c.Call(ctx, "get_reward_targets", request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
@@ -8,21 +8,99 @@ import (
 	"io/ioutil"
 )
 
+// a chia service on one host with its tls identity, missing fields fall back to the top level settings
+type ServiceConfig struct {
+	Host        string `mapstructure:"host" json:"host,omitempty"`
+	Port        uint   `mapstructure:"port" json:"port,omitempty"`
+	PrivateCert string `mapstructure:"private_cert" json:"private_cert,omitempty"`
+	PrivateKey  string `mapstructure:"private_key" json:"private_key,omitempty"`
+	CaCert      string `mapstructure:"ca_cert" json:"ca_cert,omitempty"`
+}
+
+func (s *ServiceConfig) fill(host string, port uint, config *Config) {
+	if s.Host == "" {
+		s.Host = host
+	}
+	if s.Port == 0 {
+		s.Port = port
+	}
+	if s.PrivateCert == "" {
+		s.PrivateCert = config.PrivateCert
+	}
+	if s.PrivateKey == "" {
+		s.PrivateKey = config.PrivateKey
+	}
+	if s.CaCert == "" {
+		s.CaCert = config.CaCert
+	}
+}
+
+func (s *ServiceConfig) validate(name string) error {
+	if s.Host == "" || s.Port == 0 {
+		return fmt.Errorf("error config: host and port of %s can not be empty", name)
+	}
+	if s.PrivateCert == "" || s.PrivateKey == "" || s.CaCert == "" {
+		return fmt.Errorf("error config: private_cert, private_key and ca_cert of %s can not be empty", name)
+	}
+	return nil
+}
+
+// the services a command uses
+type ConfigNeeds uint
+
+const (
+	NeedDb ConfigNeeds = 1 << iota
+	NeedFullNode
+	NeedWallet
+	NeedHarvester
+	NeedFarmer
+)
+
 type Config struct {
 	Dsn string
 	RpcHost string
 	FullNodeRpcPort uint
 	HarvesterRpcPort uint
+	FarmerRpcPort uint
 	WalletRpcPort uint
 	WalletId uint
 	PrivateCert string
 	PrivateKey string
 	CaCert string
 	SyncBlocks bool
+	FullNodes []ServiceConfig
+	Wallet ServiceConfig
+	Harvesters []ServiceConfig
+	Farmer ServiceConfig
+	Daemon ServiceConfig
+	CrossCheckHeaderHash bool
+	WatchlistMode bool
+	Watchlist []string
+	DaemonHost string
+	DaemonPort uint
+	MaxReorgDepth uint64
+	BlockchainStateInterval uint
+	IntegrityCheckInterval uint
+	QuarantineBlocks bool
+	QuarantineAfter uint
+	ReportTimezones []ReportTimezone
+	BackfillWorkers uint
+	BackfillRangeSize uint64
+	BackfillMaxInFlight uint64
+	RunComponents []string
+	RpcTimeout uint
+	RpcTimeouts map[string]uint
+	RpcRetries uint
+	RpcBreakerFailures uint
+	RpcBreakerCooldown uint
+	TransactionBlocks bool
+	RpcRecord string
+	RpcReplay string
 	IgnoreGormNotFoundError bool
 }
 
-func NewConfig(ctx *cli.Context) (*Config, error) {
+// read the config of a command, only the settings of the services in needs are validated
+func NewConfig(ctx *cli.Context, needs ConfigNeeds) (*Config, error) {
 	var config Config
 	viper.SetConfigType("json") // REQUIRED if the config file does not have the extension in the name
 	configFile := ctx.String("config")
@@ -55,40 +133,211 @@ func NewConfig(ctx *cli.Context) (*Config, error) {
 	config.FullNodeRpcPort = viper.GetUint("full_node_rpc_port")
 	config.WalletRpcPort = viper.GetUint("wallet_rpc_port")
 	config.HarvesterRpcPort = viper.GetUint("harvester_rpc_port")
+	config.FarmerRpcPort = viper.GetUint("farmer_rpc_port")
 	config.WalletId = viper.GetUint("wallet_id")
 	config.PrivateCert = viper.GetString("private_cert")
 	config.PrivateKey = viper.GetString("private_key")
 	config.CaCert = viper.GetString("ca_cert")
 	config.SyncBlocks = viper.GetBool("sync_blocks")
 	config.Dsn = viper.GetString("dsn")
+	err := viper.UnmarshalKey("full_nodes", &config.FullNodes)
+	if err != nil {
+		return nil, fmt.Errorf("error config: invalid full_nodes: %v", err)
+	}
+	err = viper.UnmarshalKey("wallet", &config.Wallet)
+	if err != nil {
+		return nil, fmt.Errorf("error config: invalid wallet: %v", err)
+	}
+	err = viper.UnmarshalKey("harvesters", &config.Harvesters)
+	if err != nil {
+		return nil, fmt.Errorf("error config: invalid harvesters: %v", err)
+	}
+	err = viper.UnmarshalKey("farmer", &config.Farmer)
+	if err != nil {
+		return nil, fmt.Errorf("error config: invalid farmer: %v", err)
+	}
+	err = viper.UnmarshalKey("daemon", &config.Daemon)
+	if err != nil {
+		return nil, fmt.Errorf("error config: invalid daemon: %v", err)
+	}
+	err = viper.UnmarshalKey("rpc_timeouts", &config.RpcTimeouts)
+	if err != nil {
+		return nil, fmt.Errorf("error config: invalid rpc_timeouts: %v", err)
+	}
+	config.RpcTimeout = viper.GetUint("rpc_timeout")
+	config.RpcRetries = viper.GetUint("rpc_retries")
+	config.RpcBreakerFailures = viper.GetUint("rpc_breaker_failures")
+	config.RpcBreakerCooldown = viper.GetUint("rpc_breaker_cooldown")
+	config.CrossCheckHeaderHash = viper.GetBool("cross_check_header_hash")
+	config.WatchlistMode = viper.GetBool("watchlist_mode")
+	for _, entry := range viper.GetStringSlice("watchlist") {
+		address, err := NormalizeWatchAddress(entry)
+		if err != nil {
+			return nil, fmt.Errorf("error config: watchlist: %v", err)
+		}
+		config.Watchlist = append(config.Watchlist, address)
+	}
+	config.DaemonHost = viper.GetString("daemon_host")
+	config.DaemonPort = viper.GetUint("daemon_port")
+	config.MaxReorgDepth = viper.GetUint64("max_reorg_depth")
+	config.BlockchainStateInterval = viper.GetUint("blockchain_state_interval")
+	config.IntegrityCheckInterval = viper.GetUint("integrity_check_interval")
+	config.QuarantineBlocks = viper.GetBool("quarantine_blocks")
+	config.QuarantineAfter = viper.GetUint("quarantine_after")
+	timezones, err := LoadReportTimezones(viper.GetStringSlice("report_timezones"))
+	if err != nil {
+		return nil, err
+	}
+	config.ReportTimezones = timezones
+	config.BackfillWorkers = viper.GetUint("backfill_workers")
+	config.BackfillRangeSize = viper.GetUint64("backfill_range_size")
+	config.BackfillMaxInFlight = viper.GetUint64("backfill_max_in_flight")
+	config.RunComponents = viper.GetStringSlice("run_components")
+	config.TransactionBlocks = viper.GetBool("transaction_blocks")
+	config.RpcRecord = viper.GetString("rpc_record")
+	config.RpcReplay = viper.GetString("rpc_replay")
+	if ctx.GlobalIsSet("rpc-record") {
+		config.RpcRecord = ctx.GlobalString("rpc-record")
+	}
+	if ctx.GlobalIsSet("rpc-replay") {
+		config.RpcReplay = ctx.GlobalString("rpc-replay")
+	}
+	if config.RpcRecord != "" && config.RpcReplay != "" {
+		return nil, fmt.Errorf("error config: rpc_record can not be combined with rpc_replay")
+	}
 
-	if config.RpcHost == "" {
-		return nil, fmt.Errorf("error config: rpc_host can not be empty")
+	for index := range config.FullNodes {
+		config.FullNodes[index].fill("", 0, &config)
 	}
-	if config.FullNodeRpcPort == 0 {
-		return nil, fmt.Errorf("error config: full_node_rpc_port can not be empty")
+	if len(config.FullNodes) == 0 && config.FullNodeRpcPort != 0 {
+		node := ServiceConfig{}
+		node.fill(config.RpcHost, config.FullNodeRpcPort, &config)
+		config.FullNodes = []ServiceConfig{node}
 	}
-	if config.WalletRpcPort == 0 {
-		return nil, fmt.Errorf("error config: wallet_rpc_port can not be empty")
+	for index := range config.Harvesters {
+		config.Harvesters[index].fill(config.RpcHost, config.HarvesterRpcPort, &config)
 	}
-	if config.HarvesterRpcPort == 0 {
-		return nil, fmt.Errorf("error config: harvester_rpc_port can not be empty")
+	if len(config.Harvesters) == 0 && config.HarvesterRpcPort != 0 {
+		harvester := ServiceConfig{}
+		harvester.fill(config.RpcHost, config.HarvesterRpcPort, &config)
+		config.Harvesters = []ServiceConfig{harvester}
 	}
-	if config.PrivateCert == "" {
-		return nil, fmt.Errorf("error config: private_cert can not be empty")
+	if config.FarmerRpcPort == 0 {
+		config.FarmerRpcPort = DefaultFarmerRpcPort
 	}
-	if config.PrivateKey == "" {
-		return nil, fmt.Errorf("error config: private_key can not be empty")
+	if config.DaemonHost == "" {
+		config.DaemonHost = config.RpcHost
 	}
-	if config.CaCert == "" {
-		return nil, fmt.Errorf("error config: ca_cert can not be empty")
+	config.Wallet.fill(config.RpcHost, config.WalletRpcPort, &config)
+	config.Farmer.fill(config.RpcHost, config.FarmerRpcPort, &config)
+	config.Daemon.fill(config.DaemonHost, config.DaemonPort, &config)
+	err = config.Validate(needs)
+	if err != nil {
+		return nil, err
 	}
-	if config.Dsn == "" {
-		return nil, fmt.Errorf("error config: dsn can not be empty")
+	if config.SyncBlocks && config.WatchlistMode {
+		return nil, fmt.Errorf("error config: sync_blocks stores every block, it can not be used with watchlist_mode")
 	}
 	if config.WalletId == 0 {
 		config.WalletId = 1
 	}
+	if config.MaxReorgDepth == 0 {
+		config.MaxReorgDepth = DefaultMaxReorgDepth
+	}
+	if config.BlockchainStateInterval == 0 {
+		config.BlockchainStateInterval = DefaultBlockchainStateInterval
+	}
+	if config.IntegrityCheckInterval == 0 {
+		config.IntegrityCheckInterval = DefaultIntegrityCheckInterval
+	}
+	if config.QuarantineAfter == 0 {
+		config.QuarantineAfter = DefaultQuarantineAfter
+	}
+	if config.BackfillWorkers == 0 {
+		config.BackfillWorkers = DefaultBackfillWorkers
+	}
+	if config.BackfillRangeSize == 0 {
+		config.BackfillRangeSize = DefaultBackfillRangeSize
+	}
+	if config.BackfillMaxInFlight == 0 {
+		config.BackfillMaxInFlight = DefaultBackfillMaxInFlight
+	}
+	if config.RpcTimeout == 0 {
+		config.RpcTimeout = DefaultRpcTimeout
+	}
+	// 0 turns retries off
+	if !viper.IsSet("rpc_retries") {
+		config.RpcRetries = DefaultRpcRetries
+	}
+	if config.RpcBreakerFailures == 0 {
+		config.RpcBreakerFailures = DefaultRpcBreakerFailures
+	}
+	if config.RpcBreakerCooldown == 0 {
+		config.RpcBreakerCooldown = DefaultRpcBreakerCooldown
+	}
+	if len(config.RunComponents) == 0 {
+		config.RunComponents = DefaultRunComponents
+	}
 
 	return &config, nil
 }
+
+// replayed calls are not sent, so only the host and port of a service are needed
+func (c *Config) validateService(service *ServiceConfig, name string) error {
+	if c.RpcReplay != "" && service.Host != "" && service.Port != 0 {
+		return nil
+	}
+	return service.validate(name)
+}
+
+// check the settings of the services in needs
+func (c *Config) Validate(needs ConfigNeeds) error {
+	if needs&NeedDb != 0 && c.Dsn == "" {
+		return fmt.Errorf("error config: dsn can not be empty")
+	}
+	if needs&NeedFullNode != 0 {
+		if len(c.FullNodes) == 0 {
+			return fmt.Errorf("error config: full_node_rpc_port can not be empty")
+		}
+		for index := range c.FullNodes {
+			err := c.validateService(&c.FullNodes[index], fmt.Sprintf("full_nodes[%d]", index))
+			if err != nil {
+				return err
+			}
+		}
+		// the daemon websocket of sync is optional
+		if c.Daemon.Port != 0 {
+			err := c.validateService(&c.Daemon, "daemon")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if needs&NeedWallet != 0 {
+		if c.Wallet.Port == 0 {
+			return fmt.Errorf("error config: wallet_rpc_port can not be empty")
+		}
+		err := c.validateService(&c.Wallet, "wallet")
+		if err != nil {
+			return err
+		}
+	}
+	if needs&NeedHarvester != 0 {
+		if len(c.Harvesters) == 0 {
+			return fmt.Errorf("error config: harvester_rpc_port can not be empty")
+		}
+		for index := range c.Harvesters {
+			err := c.validateService(&c.Harvesters[index], fmt.Sprintf("harvesters[%d]", index))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if needs&NeedFarmer != 0 {
+		err := c.validateService(&c.Farmer, "farmer")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// chia root used when neither --chia-root nor CHIA_ROOT is set, relative to the home directory
+const defaultChiaRoot = ".chia/mainnet"
+
+// the dsn written by config init when --dsn is not given
+const placeholderDsn = "USERNAME:PASSWORD@tcp(DB_HOST:DB_PORT)/DB_NAME?charset=utf8mb4&parseTime=True&loc=Local"
+
+// the services of a chia config.yaml, by section name
+var chiaServices = []string{"full_node", "wallet", "harvester", "farmer"}
+
+// a chia-reporter config generated from a chia config.yaml.
+// the full node uses the top-level identity, the other services their own one.
+type DiscoveredConfig struct {
+	Dsn              string          `json:"dsn"`
+	RpcHost          string          `json:"rpc_host"`
+	FullNodeRpcPort  uint            `json:"full_node_rpc_port"`
+	WalletRpcPort    uint            `json:"wallet_rpc_port"`
+	HarvesterRpcPort uint            `json:"harvester_rpc_port"`
+	FarmerRpcPort    uint            `json:"farmer_rpc_port"`
+	DaemonPort       uint            `json:"daemon_port"`
+	PrivateCert      string          `json:"private_cert"`
+	PrivateKey       string          `json:"private_key"`
+	CaCert           string          `json:"ca_cert"`
+	Wallet           ServiceConfig   `json:"wallet"`
+	Harvesters       []ServiceConfig `json:"harvesters"`
+	Farmer           ServiceConfig   `json:"farmer"`
+	Daemon           ServiceConfig   `json:"daemon"`
+}
+
+// the chia root of the flag, CHIA_ROOT or ~/.chia/mainnet
+func ChiaRoot(ctx *cli.Context) (string, error) {
+	root := ctx.String("chia-root")
+	if root == "" {
+		root = os.Getenv("CHIA_ROOT")
+	}
+	if root == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("error find home directory: %v", err)
+		}
+		root = filepath.Join(home, defaultChiaRoot)
+	}
+	return filepath.Abs(root)
+}
+
+// a path of the chia config, relative paths are relative to the chia root
+func chiaPath(root string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(root, path)
+}
+
+// the private identity of a service, chia writes it to config/ssl/<service>/private_<service>.crt|key by default
+func discoverIdentity(root string, chia *viper.Viper, section string, service string) ServiceConfig {
+	cert := chia.GetString(section + ".private_crt")
+	if cert == "" {
+		cert = filepath.Join("config", "ssl", service, "private_"+service+".crt")
+	}
+	key := chia.GetString(section + ".private_key")
+	if key == "" {
+		key = filepath.Join("config", "ssl", service, "private_"+service+".key")
+	}
+	return ServiceConfig{PrivateCert: chiaPath(root, cert), PrivateKey: chiaPath(root, key)}
+}
+
+// read the ports and certs of the local chia services from config/config.yaml of the chia root.
+// the returned warnings name the cert files which do not exist.
+func DiscoverConfig(root string) (*DiscoveredConfig, []string, error) {
+	file := filepath.Join(root, "config", "config.yaml")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error read chia config: %v", err)
+	}
+	chia := viper.New()
+	chia.SetConfigType("yaml")
+	err = chia.ReadConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parse chia config %s: %v", file, err)
+	}
+
+	host := chia.GetString("self_hostname")
+	if host == "" {
+		host = "localhost"
+	}
+	ca := chia.GetString("private_ssl_ca.crt")
+	if ca == "" {
+		ca = filepath.Join("config", "ssl", "ca", "private_ca.crt")
+	}
+	identities := make(map[string]ServiceConfig)
+	for _, service := range chiaServices {
+		identity := discoverIdentity(root, chia, service+".ssl", service)
+		identity.CaCert = chiaPath(root, ca)
+		identities[service] = identity
+	}
+	daemon := discoverIdentity(root, chia, "daemon_ssl", "daemon")
+	daemon.CaCert = chiaPath(root, ca)
+
+	fullNode := identities["full_node"]
+	config := &DiscoveredConfig{
+		Dsn:              placeholderDsn,
+		RpcHost:          host,
+		FullNodeRpcPort:  chia.GetUint("full_node.rpc_port"),
+		WalletRpcPort:    chia.GetUint("wallet.rpc_port"),
+		HarvesterRpcPort: chia.GetUint("harvester.rpc_port"),
+		FarmerRpcPort:    chia.GetUint("farmer.rpc_port"),
+		DaemonPort:       chia.GetUint("daemon_port"),
+		PrivateCert:      fullNode.PrivateCert,
+		PrivateKey:       fullNode.PrivateKey,
+		CaCert:           fullNode.CaCert,
+		Wallet:           identities["wallet"],
+		Harvesters:       []ServiceConfig{identities["harvester"]},
+		Farmer:           identities["farmer"],
+		Daemon:           daemon,
+	}
+
+	var warnings []string
+	for _, service := range chiaServices {
+		if chia.GetUint(service+".rpc_port") == 0 {
+			warnings = append(warnings, fmt.Sprintf("no rpc_port of %s in %s", service, file))
+		}
+	}
+	files := []string{fullNode.CaCert, daemon.PrivateCert, daemon.PrivateKey}
+	for _, service := range chiaServices {
+		files = append(files, identities[service].PrivateCert, identities[service].PrivateKey)
+	}
+	for _, path := range files {
+		_, err := os.Stat(path)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("cert file %s not found", path))
+		}
+	}
+	return config, warnings, nil
+}
+
+func discoverAction(ctx *cli.Context) ([]byte, error) {
+	root, err := ChiaRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config, warnings, err := DiscoverConfig(root)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.String("dsn") != "" {
+		config.Dsn = ctx.String("dsn")
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s \r\n", warning)
+	}
+	// the & of the dsn is kept as is
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(config)
+	if err != nil {
+		return nil, fmt.Errorf("error encode config: %v", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// print the config discovered from the chia root
+func ConfigDiscoverAction(ctx *cli.Context) error {
+	data, err := discoverAction(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// write the config discovered from the chia root, an existing file is only replaced with --force
+func ConfigInitAction(ctx *cli.Context) error {
+	output := ctx.String("output")
+	if !ctx.Bool("force") {
+		_, err := os.Stat(output)
+		if err == nil {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", output)
+		}
+	}
+	data, err := discoverAction(ctx)
+	if err != nil {
+		return err
+	}
+	// the config holds the password of the database
+	err = ioutil.WriteFile(output, data, 0600)
+	if err != nil {
+		return fmt.Errorf("error write config: %v", err)
+	}
+	fmt.Printf("config written to %s \r\n", output)
+	if ctx.String("dsn") == "" {
+		fmt.Printf("set dsn in %s before running sync \r\n", output)
+	}
+	return nil
+}
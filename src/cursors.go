@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"os"
+	"time"
+)
+
+// cursor of block ingestion, the farmer aggregates are built in the same transaction and share it
+const CursorBlocks = "blocks"
+const pipelineBatch = 1000
+
+// a derived pipeline processing the stored block records in height order behind block ingestion.
+// each pipeline tracks its own cursor, so a new pipeline starts from the lowest stored block and catches up on its own.
+type Pipeline struct {
+	Name string
+	// blocks applied per transaction, pipelineBatch if 0
+	Batch uint64
+	// whether config enables the pipeline, always if nil
+	Enabled func(config *Config) bool
+	// fetch what the blocks need without a transaction, pool is the full node pool of sync.
+	// the returned write stores the results in the transaction which moves the cursor.
+	Apply func(ctx context.Context, pool *FullNodePool, blocks []ChiaBlockRecord, config *Config) (func(tx *gorm.DB) error, error)
+	// undo the blocks from height from on, after a chain reorg or before they are processed again, optional
+	Rollback func(from uint64, config *Config, tx *gorm.DB) error
+}
+
+// pipelines followed by sync, requires sync_blocks
+var Pipelines = []*Pipeline{
+	{
+		Name:     CursorTransactionBlocks,
+		Batch:    transactionBlocksBatch,
+		Enabled:  func(config *Config) bool { return config.TransactionBlocks },
+		Apply:    ApplyTransactionBlocks,
+		Rollback: RollbackTransactionBlocks,
+	},
+}
+
+// the pipelines config enables
+func EnabledPipelines(config *Config) []*Pipeline {
+	var pipelines []*Pipeline
+	for _, pipeline := range Pipelines {
+		if pipeline.Enabled == nil || pipeline.Enabled(config) {
+			pipelines = append(pipelines, pipeline)
+		}
+	}
+	return pipelines
+}
+
+func GetCursor(db *gorm.DB, name string) (*ChiaBlockSyncHeight, error) {
+	var cursor ChiaBlockSyncHeight
+	r := db.Where("name = ?", name).Take(&cursor)
+	if r.Error == nil {
+		return &cursor, nil
+	} else if errors.Is(r.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else {
+		return nil, fmt.Errorf("error get cursor %s: %v", name, r.Error)
+	}
+}
+
+func SetCursor(db *gorm.DB, name string, height uint64, headerHash string) error {
+	cursor := ChiaBlockSyncHeight{Name: name, Height: height, HeaderHash: headerHash}
+	r := db.Clauses(clause.OnConflict{
+		DoUpdates: clause.AssignmentColumns([]string{"height", "header_hash", "updated_at"}),
+	}).Create(&cursor)
+	if r.Error != nil {
+		return fmt.Errorf("error set cursor %s: %v", name, r.Error)
+	}
+	return nil
+}
+
+func ListCursors(db *gorm.DB) ([]ChiaBlockSyncHeight, error) {
+	var cursors []ChiaBlockSyncHeight
+	r := db.Order("name").Find(&cursors)
+	if r.Error != nil {
+		return nil, fmt.Errorf("error list cursors: %v", r.Error)
+	}
+	return cursors, nil
+}
+
+// apply the next batch of stored blocks after the pipeline's cursor, returns the number of heights processed.
+// the pipeline fetches the data of the batch before the transaction which writes it and moves the cursor,
+// so neither the cursor nor a chain reorg waits for its rpc calls.
+func RunPipeline(ctx context.Context, config *Config, db *gorm.DB, pool *FullNodePool, pipeline *Pipeline) (int, error) {
+	cursor, err := GetCursor(db, pipeline.Name)
+	if err != nil {
+		return 0, err
+	}
+	start := uint64(0)
+	cursorHash := ""
+	if cursor != nil {
+		start = cursor.Height + 1
+		cursorHash = cursor.HeaderHash
+	} else {
+		// sync_blocks may have been enabled after genesis, a new pipeline starts at the lowest stored block
+		var first ChiaBlockRecord
+		r := db.Order("height").Limit(1).Find(&first)
+		if r.Error != nil {
+			return 0, fmt.Errorf("error read lowest stored block: %v", r.Error)
+		}
+		if r.RowsAffected == 0 {
+			return 0, nil
+		}
+		start = first.Height
+	}
+	synced, err := GetSyncedHeight(db)
+	if err != nil {
+		return 0, err
+	}
+	if synced == nil || synced.Height < start {
+		return 0, nil
+	}
+	batch := pipeline.Batch
+	if batch == 0 {
+		batch = pipelineBatch
+	}
+	end := start + batch - 1
+	if end > synced.Height {
+		end = synced.Height
+	}
+	var blocks []ChiaBlockRecord
+	r := db.Where("height >= ? and height <= ?", start, end).Order("height").Find(&blocks)
+	if r.Error != nil {
+		return 0, fmt.Errorf("error read blocks: %v", r.Error)
+	}
+	var quarantined []uint64
+	r = db.Model(&ChiaQuarantinedBlock{}).Where("height >= ? and height <= ?", start, end).Pluck("height", &quarantined)
+	if r.Error != nil {
+		return 0, fmt.Errorf("error read quarantined blocks: %v", r.Error)
+	}
+	height, headerHash, err := pipelineRange(cursorHash, start, end, blocks, quarantined)
+	if err != nil {
+		return 0, fmt.Errorf("cursor %s: %v", pipeline.Name, err)
+	}
+	var write func(tx *gorm.DB) error
+	if len(blocks) > 0 {
+		write, err = pipeline.Apply(ctx, pool, blocks, config)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// the lock keeps a concurrent run or rollback from moving the cursor
+		var locked ChiaBlockSyncHeight
+		r := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", pipeline.Name).Limit(1).Find(&locked)
+		if r.Error != nil {
+			return fmt.Errorf("error get cursor %s: %v", pipeline.Name, r.Error)
+		}
+		if (r.RowsAffected > 0) != (cursor != nil) || (cursor != nil && (locked.Height != cursor.Height || locked.HeaderHash != cursor.HeaderHash)) {
+			return fmt.Errorf("cursor %s moved while its blocks were fetched", pipeline.Name)
+		}
+		// a chain reorg may have replaced the blocks meanwhile
+		var stored []ChiaBlockRecord
+		r = tx.Select("height", "header_hash").Where("height >= ? and height <= ?", start, end).Order("height").Find(&stored)
+		if r.Error != nil {
+			return fmt.Errorf("error read blocks: %v", r.Error)
+		}
+		if len(stored) != len(blocks) {
+			return fmt.Errorf("blocks of cursor %s changed while they were fetched", pipeline.Name)
+		}
+		for index := range stored {
+			if stored[index].Height != blocks[index].Height || stored[index].HeaderHash != blocks[index].HeaderHash {
+				return fmt.Errorf("blocks of cursor %s changed while they were fetched", pipeline.Name)
+			}
+		}
+		if write != nil {
+			err := write(tx)
+			if err != nil {
+				return err
+			}
+		}
+		return SetCursor(tx, pipeline.Name, height, headerHash)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(height - start + 1), nil
+}
+
+// check the stored blocks of [start, end] extend the cursor, the quarantined heights have no stored block and are skipped.
+// returns the height and header hash the cursor moves to, the hash is empty if the last height is quarantined.
+func pipelineRange(cursorHash string, start uint64, end uint64, blocks []ChiaBlockRecord, quarantined []uint64) (uint64, string, error) {
+	skipped := make(map[uint64]bool)
+	for _, height := range quarantined {
+		skipped[height] = true
+	}
+	height := start
+	prevHash := cursorHash
+	for _, block := range blocks {
+		for height < block.Height && skipped[height] {
+			// the block after a quarantined one can not be linked
+			height++
+			prevHash = ""
+		}
+		if block.Height != height || !BlocksLinked(prevHash, []ChiaBlockRecord{block}) {
+			return 0, "", fmt.Errorf("stored blocks from height %d do not extend the cursor", height)
+		}
+		height++
+		prevHash = block.HeaderHash
+	}
+	for height <= end && skipped[height] {
+		height++
+		prevHash = ""
+	}
+	if height <= end {
+		return 0, "", fmt.Errorf("stored block of height %d not found", height)
+	}
+	return end, prevHash, nil
+}
+
+// keep a pipeline caught up with block ingestion until ctx is done
+func FollowPipeline(ctx context.Context, config *Config, db *gorm.DB, pool *FullNodePool, pipeline *Pipeline, interval time.Duration) {
+	for {
+		applied, err := RunPipeline(ctx, config, db, pool, pipeline)
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("error run pipeline %s: %v \r\n", pipeline.Name, err)
+		}
+		if err == nil && applied > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// move the cursors of the derived pipelines back to the fork point of a chain reorg
+func RewindCursors(fork *ChiaBlockRecord, config *Config, db *gorm.DB) error {
+	return resetCursors(fork.Height+1, fork.HeaderHash, config, db)
+}
+
+// move the cursors of the derived pipelines before height from and undo their results from there,
+// so the blocks from there are processed again. cursors reset to height 0 are deleted.
+func ResetCursors(from uint64, config *Config, db *gorm.DB) error {
+	prevHash := ""
+	if from > 0 {
+		// the hash is empty if the block before is not stored, e.g. quarantined
+		var prev ChiaBlockRecord
+		r := db.Where("height = ?", from-1).Limit(1).Find(&prev)
+		if r.Error != nil {
+			return fmt.Errorf("error read block %d: %v", from-1, r.Error)
+		}
+		prevHash = prev.HeaderHash
+	}
+	return resetCursors(from, prevHash, config, db)
+}
+
+func resetCursors(from uint64, prevHash string, config *Config, db *gorm.DB) error {
+	var cursors []ChiaBlockSyncHeight
+	r := db.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("name <> ? and height >= ?", CursorBlocks, from).Find(&cursors)
+	if r.Error != nil {
+		return fmt.Errorf("error read cursors: %v", r.Error)
+	}
+	for _, cursor := range cursors {
+		for _, pipeline := range Pipelines {
+			if pipeline.Name == cursor.Name && pipeline.Rollback != nil {
+				err := pipeline.Rollback(from, config, db)
+				if err != nil {
+					return fmt.Errorf("error rollback pipeline %s: %v", pipeline.Name, err)
+				}
+			}
+		}
+		if from == 0 {
+			r = db.Where("name = ?", cursor.Name).Delete(&ChiaBlockSyncHeight{})
+			if r.Error != nil {
+				return fmt.Errorf("error delete cursor %s: %v", cursor.Name, r.Error)
+			}
+			continue
+		}
+		err := SetCursor(db, cursor.Name, from-1, prevHash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type CursorLag struct {
+	Name         string    `json:"name"`
+	Height       *uint64   `json:"height"`
+	HeaderHash   string    `json:"header_hash"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	BehindBlocks uint64    `json:"behind_blocks"`
+	BehindPeak   *uint64   `json:"behind_peak"`
+}
+
+// lag of each cursor behind block ingestion and the full node's peak, peak may be nil.
+// enabled pipelines which have not started yet are listed without a height.
+func CursorLags(db *gorm.DB, config *Config, peak *uint64) ([]CursorLag, error) {
+	cursors, err := ListCursors(db)
+	if err != nil {
+		return nil, err
+	}
+	synced, err := GetSyncedHeight(db)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool)
+	var lags []CursorLag
+	for _, cursor := range cursors {
+		height := cursor.Height
+		lag := CursorLag{Name: cursor.Name, Height: &height, HeaderHash: cursor.HeaderHash, UpdatedAt: cursor.UpdatedAt}
+		if synced != nil && synced.Height > height {
+			lag.BehindBlocks = synced.Height - height
+		}
+		if peak != nil {
+			behind := uint64(0)
+			if *peak > height {
+				behind = *peak - height
+			}
+			lag.BehindPeak = &behind
+		}
+		lags = append(lags, lag)
+		listed[cursor.Name] = true
+	}
+	for _, pipeline := range EnabledPipelines(config) {
+		if !listed[pipeline.Name] {
+			lag := CursorLag{Name: pipeline.Name}
+			if synced != nil {
+				lag.BehindBlocks = synced.Height + 1
+			}
+			if peak != nil {
+				behind := *peak + 1
+				lag.BehindPeak = &behind
+			}
+			lags = append(lags, lag)
+		}
+	}
+	return lags, nil
+}
+
+func CursorsAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb)
+	if err != nil {
+		return err
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+
+	var peak *uint64
+	pool, err := NewFullNodePool(config)
+	if err == nil {
+		var node *FullNodeClient
+		node, err = pool.Select(context.Background())
+		if err == nil {
+			var height uint64
+			height, err = node.GetPeakHeight(context.Background())
+			if err == nil {
+				peak = &height
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error get peak height, lag behind the peak is unknown: %v \r\n", err)
+	}
+
+	lags, err := CursorLags(db, config, peak)
+	if err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(lags)
+	}
+	fmt.Printf("%-24s %12s %14s %12s  %s \r\n", "name", "height", "behind blocks", "behind peak", "updated at")
+	for _, lag := range lags {
+		height, behindPeak, updatedAt := "-", "-", "-"
+		if lag.Height != nil {
+			height = fmt.Sprintf("%d", *lag.Height)
+			updatedAt = lag.UpdatedAt.Format("2006-01-02 15:04:05")
+		}
+		if lag.BehindPeak != nil {
+			behindPeak = fmt.Sprintf("%d", *lag.BehindPeak)
+		}
+		fmt.Printf("%-24s %12s %14d %12s  %s \r\n", lag.Name, height, lag.BehindBlocks, behindPeak, updatedAt)
+	}
+	return nil
+}
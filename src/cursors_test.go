@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestPipelineRange(t *testing.T) {
+	block := func(height uint64) ChiaBlockRecord {
+		return ChiaBlockRecord{Height: height, HeaderHash: testHeaderHash(height), PrevHash: testHeaderHash(height - 1)}
+	}
+	cases := []struct {
+		name        string
+		cursorHash  string
+		start       uint64
+		end         uint64
+		blocks      []ChiaBlockRecord
+		quarantined []uint64
+		height      uint64
+		headerHash  string
+		ok          bool
+	}{
+		{"extends the cursor", testHeaderHash(9), 10, 12, []ChiaBlockRecord{block(10), block(11), block(12)}, nil, 12, testHeaderHash(12), true},
+		{"new pipeline", "", 10, 11, []ChiaBlockRecord{block(10), block(11)}, nil, 11, testHeaderHash(11), true},
+		{"skips a quarantined block", testHeaderHash(9), 10, 12, []ChiaBlockRecord{block(10), block(12)}, []uint64{11}, 12, testHeaderHash(12), true},
+		{"ends with a quarantined block", testHeaderHash(9), 10, 12, []ChiaBlockRecord{block(10), block(11)}, []uint64{12}, 12, "", true},
+		{"only quarantined blocks", testHeaderHash(9), 10, 11, nil, []uint64{10, 11}, 11, "", true},
+		{"does not extend the cursor", testHeaderHash(8), 10, 11, []ChiaBlockRecord{block(10), block(11)}, nil, 0, "", false},
+		{"missing block", testHeaderHash(9), 10, 12, []ChiaBlockRecord{block(10), block(12)}, nil, 0, "", false},
+		{"missing last block", testHeaderHash(9), 10, 12, []ChiaBlockRecord{block(10), block(11)}, nil, 0, "", false},
+	}
+	for _, c := range cases {
+		height, headerHash, err := pipelineRange(c.cursorHash, c.start, c.end, c.blocks, c.quarantined)
+		if (err == nil) != c.ok || height != c.height || headerHash != c.headerHash {
+			t.Errorf("%s: got %d %q %v, expected %d %q and ok %v", c.name, height, headerHash, err, c.height, c.headerHash, c.ok)
+		}
+	}
+}
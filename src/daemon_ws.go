@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+// the daemon forwards the full node's state changes to the services registered as wallet_ui
+const daemonServiceName = "wallet_ui"
+const daemonMaxBackoff = 60 * time.Second
+
+type DaemonMessage struct {
+	Command     string          `json:"command"`
+	Ack         bool            `json:"ack"`
+	Data        json.RawMessage `json:"data"`
+	RequestId   string          `json:"request_id"`
+	Destination string          `json:"destination"`
+	Origin      string          `json:"origin"`
+}
+
+func NewDaemonMessage(command string, data interface{}) (*DaemonMessage, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	requestId := make([]byte, 32)
+	_, err = rand.Read(requestId)
+	if err != nil {
+		return nil, err
+	}
+	return &DaemonMessage{
+		Command:     command,
+		Data:        raw,
+		RequestId:   hex.EncodeToString(requestId),
+		Destination: "daemon",
+		Origin:      daemonServiceName,
+	}, nil
+}
+
+// peak height carried by a new peak/block event, ok is false for other messages
+func NewPeakFromMessage(message *DaemonMessage) (uint64, bool) {
+	if message.Command != "get_blockchain_state" && message.Command != "block" {
+		return 0, false
+	}
+	var state BlockchainStateResponse
+	err := json.Unmarshal(message.Data, &state)
+	if err == nil && state.BlockchainState.Peak != nil {
+		return state.BlockchainState.Peak.Height, true
+	}
+	var block struct {
+		Height uint64 `json:"height"`
+	}
+	err = json.Unmarshal(message.Data, &block)
+	if err != nil {
+		return 0, true
+	}
+	return block.Height, true
+}
+
+// connect to the daemon websocket, register for state changes and send the peak height of each new peak to peaks.
+// returns when the connection drops or ctx is done.
+func ReadDaemonEvents(ctx context.Context, url string, tlsConfig *tls.Config, peaks chan<- uint64) error {
+	dialer := websocket.Dialer{
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: 10 * time.Second,
+	}
+	conn, _, err := dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return fmt.Errorf("error connect daemon: %v", err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	register, err := NewDaemonMessage("register_service", map[string]string{"service": daemonServiceName})
+	if err != nil {
+		return err
+	}
+	err = conn.WriteJSON(register)
+	if err != nil {
+		return fmt.Errorf("error register service: %v", err)
+	}
+
+	for {
+		var message DaemonMessage
+		err = conn.ReadJSON(&message)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("error read daemon message: %v", err)
+		}
+		height, ok := NewPeakFromMessage(&message)
+		if !ok {
+			continue
+		}
+		// a pending notification already triggers a sync, drop the event if nobody is waiting
+		select {
+		case peaks <- height:
+		default:
+		}
+	}
+}
+
+// keep a websocket connection to the configured daemon open
+func WatchNewPeaks(ctx context.Context, config *Config, peaks chan<- uint64) {
+	daemon := config.Daemon
+	identity, err := NewTLSIdentity(daemon.PrivateCert, daemon.PrivateKey, daemon.CaCert)
+	if err != nil {
+		fmt.Printf("error create daemon tls config: %v \r\n", err)
+		return
+	}
+	// a reconnect after the certs were rotated uses the new ones
+	WatchDaemonEvents(ctx, fmt.Sprintf("wss://%s:%d", daemon.Host, daemon.Port), identity.TLSConfig(), peaks)
+}
+
+// read the events of a daemon websocket until ctx is done, reconnecting with backoff when it drops
+func WatchDaemonEvents(ctx context.Context, url string, tlsConfig *tls.Config, peaks chan<- uint64) {
+	backoff := time.Second
+	for {
+		began := time.Now()
+		err := ReadDaemonEvents(ctx, url, tlsConfig, peaks)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(began) > daemonMaxBackoff {
+			backoff = time.Second
+		}
+		fmt.Printf("daemon websocket closed: %v, polling until reconnected in %s \r\n", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > daemonMaxBackoff {
+			backoff = daemonMaxBackoff
+		}
+	}
+}
+
+// wait for a new peak event, or interval as the polling fallback
+func WaitForNewPeak(ctx context.Context, peaks <-chan uint64, interval time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-peaks:
+	case <-time.After(interval):
+	}
+}
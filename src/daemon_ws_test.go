@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a daemon which checks the register message of each connection and sends it the messages of that connection,
+// the first connections are closed after their messages, the last one stays open
+func testDaemon(t *testing.T, connections [][]string) (*httptest.Server, <-chan DaemonMessage) {
+	registers := make(chan DaemonMessage, len(connections)+1)
+	upgrader := websocket.Upgrader{}
+	var mu sync.Mutex
+	count := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("error upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+		var register DaemonMessage
+		err = conn.ReadJSON(&register)
+		if err != nil {
+			t.Errorf("error read register message: %v", err)
+			return
+		}
+		registers <- register
+
+		mu.Lock()
+		messages := connections[count]
+		count++
+		last := count == len(connections)
+		mu.Unlock()
+		for _, message := range messages {
+			err = conn.WriteMessage(websocket.TextMessage, []byte(message))
+			if err != nil {
+				t.Errorf("error write message: %v", err)
+				return
+			}
+		}
+		if !last {
+			return
+		}
+		// wait for the client to close the last connection
+		for {
+			_, _, err = conn.ReadMessage()
+			if err != nil {
+				return
+			}
+		}
+	}))
+	return server, registers
+}
+
+func testDaemonUrl(server *httptest.Server) string {
+	return "wss" + strings.TrimPrefix(server.URL, "https")
+}
+
+func testPeak(t *testing.T, peaks <-chan uint64) uint64 {
+	select {
+	case height := <-peaks:
+		return height
+	case <-time.After(5 * time.Second):
+		t.Fatal("no new peak")
+		return 0
+	}
+}
+
+func TestReadDaemonEventsRegistersAndParsesPeaks(t *testing.T) {
+	server, registers := testDaemon(t, [][]string{{
+		`{"command": "register_service", "ack": true, "data": {"success": true}, "origin": "daemon"}`,
+		`{"command": "get_blockchain_state", "data": {"blockchain_state": {"peak": {"height": 100}}}, "origin": "chia_full_node"}`,
+		`{"command": "get_connections", "data": {"connections": []}, "origin": "chia_full_node"}`,
+		`{"command": "block", "data": {"height": 101, "header_hash": "0x01"}, "origin": "chia_full_node"}`,
+	}})
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peaks := make(chan uint64, 2)
+	result := make(chan error, 1)
+	go func() {
+		result <- ReadDaemonEvents(ctx, testDaemonUrl(server), server.Client().Transport.(*http.Transport).TLSClientConfig, peaks)
+	}()
+
+	register := <-registers
+	if register.Command != "register_service" || register.Destination != "daemon" || register.Origin != daemonServiceName {
+		t.Fatalf("unexpected register message %+v", register)
+	}
+	var data map[string]string
+	err := json.Unmarshal(register.Data, &data)
+	if err != nil || data["service"] != daemonServiceName {
+		t.Fatalf("unexpected register data %s", register.Data)
+	}
+	if len(register.RequestId) != 64 {
+		t.Fatalf("unexpected request id %q", register.RequestId)
+	}
+
+	for _, expected := range []uint64{100, 101} {
+		height := testPeak(t, peaks)
+		if height != expected {
+			t.Fatalf("peak %d, expected %d", height, expected)
+		}
+	}
+	// the connection stays open until sync stops
+	cancel()
+	select {
+	case err = <-result:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error %v after cancel", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadDaemonEvents did not return after cancel")
+	}
+}
+
+func TestNewPeakFromMessage(t *testing.T) {
+	cases := []struct {
+		message string
+		height  uint64
+		ok      bool
+	}{
+		{`{"command": "get_blockchain_state", "data": {"blockchain_state": {"peak": {"height": 7}}}}`, 7, true},
+		{`{"command": "block", "data": {"height": 8}}`, 8, true},
+		{`{"command": "get_blockchain_state", "data": {"blockchain_state": {"peak": null}}}`, 0, true},
+		{`{"command": "get_connections", "data": {"connections": []}}`, 0, false},
+	}
+	for _, c := range cases {
+		var message DaemonMessage
+		err := json.Unmarshal([]byte(c.message), &message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		height, ok := NewPeakFromMessage(&message)
+		if height != c.height || ok != c.ok {
+			t.Errorf("%s: got %d %v, expected %d %v", c.message, height, ok, c.height, c.ok)
+		}
+	}
+}
+
+func TestWatchDaemonEventsPollsAndReconnects(t *testing.T) {
+	server, registers := testDaemon(t, [][]string{
+		{`{"command": "get_blockchain_state", "data": {"blockchain_state": {"peak": {"height": 200}}}}`},
+		{`{"command": "block", "data": {"height": 201}}`},
+	})
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	peaks := make(chan uint64, 1)
+	go func() {
+		defer close(done)
+		WatchDaemonEvents(ctx, testDaemonUrl(server), server.Client().Transport.(*http.Transport).TLSClientConfig, peaks)
+	}()
+
+	<-registers
+	if height := testPeak(t, peaks); height != 200 {
+		t.Fatalf("peak %d, expected 200", height)
+	}
+	// the daemon closed the first connection, sync falls back to polling until the websocket reconnects
+	began := time.Now()
+	WaitForNewPeak(ctx, peaks, 100*time.Millisecond)
+	if elapsed := time.Since(began); elapsed < 100*time.Millisecond {
+		t.Fatalf("WaitForNewPeak returned after %s without a new peak", elapsed)
+	}
+
+	select {
+	case <-registers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconnect after the daemon closed the connection")
+	}
+	if height := testPeak(t, peaks); height != 201 {
+		t.Fatalf("peak %d, expected 201", height)
+	}
+}
@@ -28,7 +28,7 @@ func GetDb(config *Config) (*gorm.DB, error) {
 		return nil, fmt.Errorf("failed to open db connection: %v \n", err)
 	}
 
-	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8").AutoMigrate(&ChiaBlockRecord{})
+	err = MergeDuplicateFarmerBlocks(db)
 	if err != nil {
 		return nil, fmt.Errorf("error migrate db: %v", err)
 	}
@@ -43,9 +43,105 @@ func GetDb(config *Config) (*gorm.DB, error) {
 		return nil, fmt.Errorf("error migrate db: %v", err)
 	}
 
+	// the unique key of daily blocks includes the timezone since reporting timezones are configurable
+	if db.Migrator().HasIndex(&ChiaDailyFarmerBlocks{}, "uk_dfb_farmer_address_day") {
+		err = db.Migrator().DropIndex(&ChiaDailyFarmerBlocks{}, "uk_dfb_farmer_address_day")
+		if err != nil {
+			return nil, fmt.Errorf("error migrate db: %v", err)
+		}
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='矿工每小时出块数量'").AutoMigrate(&ChiaHourlyFarmerBlocks{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='矿工每周出块数量'").AutoMigrate(&ChiaWeeklyFarmerBlocks{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='矿工每月出块数量'").AutoMigrate(&ChiaMonthlyFarmerBlocks{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
 	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='区块同步高度'").AutoMigrate(&ChiaBlockSyncHeight{})
 	if err != nil {
 		return nil, fmt.Errorf("error migrate db: %v", err)
 	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='链重组记录'").AutoMigrate(&ChiaReorgLog{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='全网状态快照'").AutoMigrate(&ChiaBlockchainState{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='矿工估算算力'").AutoMigrate(&ChiaFarmerSpaceEstimate{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='区块哈希校验不一致记录'").AutoMigrate(&ChiaHeaderHashMismatch{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='纪元统计'").AutoMigrate(&ChiaEpochStats{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='矿工每纪元出块数量'").AutoMigrate(&ChiaEpochFarmerBlocks{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='关注地址'").AutoMigrate(&ChiaWatchlist{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='关注地址出块事件'").AutoMigrate(&ChiaWonBlockEvent{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='隔离区块'").AutoMigrate(&ChiaQuarantinedBlock{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='交易区块'").AutoMigrate(&ChiaTransactionBlock{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='RPC熔断器状态'").AutoMigrate(&ChiaRpcBreaker{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='最近区块'").AutoMigrate(&ChiaRecentBlock{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
+
+	// height is a unique key, the duplicated block records are deleted from the aggregates before it is created
+	if db.Migrator().HasTable(&ChiaBlockRecord{}) && !db.Migrator().HasIndex(&ChiaBlockRecord{}, "uk_bc_height") {
+		err = DeduplicateBlockRecords(db, config)
+		if err != nil {
+			return nil, fmt.Errorf("error migrate db: %v", err)
+		}
+	}
+
+	err = db.Set("gorm:table_options", "ENGINE=InnoDB DEFAULT CHARSET=utf8").AutoMigrate(&ChiaBlockRecord{})
+	if err != nil {
+		return nil, fmt.Errorf("error migrate db: %v", err)
+	}
 	return db, nil
 }
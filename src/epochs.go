@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"os"
+	"sort"
+)
+
+// network statistics of an epoch, the EpochBlocks blocks between two difficulty resets
+type ChiaEpochStats struct {
+	ID                    uint64 `gorm:"primaryKey;<-:false" json:"id"`
+	Epoch                 uint64 `gorm:"type:bigint(20);not null;uniqueIndex:uk_es_epoch" json:"epoch"`
+	StartHeight           uint64 `gorm:"type:bigint(20);not null;default:0" json:"start_height"`
+	EndHeight             uint64 `gorm:"type:bigint(20);not null;default:0" json:"end_height"`
+	Difficulty            uint64 `gorm:"type:bigint(20);not null;default:0" json:"difficulty"`
+	SubSlotIters          uint64 `gorm:"type:bigint(20);not null;default:0" json:"sub_slot_iters"`
+	BlockCount            uint64 `gorm:"type:bigint(20);not null;default:0" json:"block_count"`
+	TransactionBlockCount uint64 `gorm:"type:bigint(20);not null;default:0" json:"transaction_block_count"`
+	Fees                  uint64 `gorm:"type:bigint(20);not null;default:0" json:"fees"`
+	StartTimestamp        uint64 `gorm:"type:bigint(20);not null;default:0" json:"start_timestamp"`
+	EndTimestamp          uint64 `gorm:"type:bigint(20);not null;default:0" json:"end_timestamp"`
+}
+
+type ChiaEpochFarmerBlocks struct {
+	ID            uint64 `gorm:"primaryKey;<-:false" json:"id"`
+	FarmerAddress string `gorm:"type:varchar(256);not null;uniqueIndex:uk_efb_farmer_address_epoch,priority:1" json:"farmer_address"`
+	Epoch         uint64 `gorm:"type:bigint(20);not null;index:idx_efb_epoch;uniqueIndex:uk_efb_farmer_address_epoch,priority:2" json:"epoch"`
+	BlockCount    uint64 `gorm:"type:bigint(20);not null;" json:"block_count"`
+}
+
+type EpochFarmer struct {
+	Epoch         uint64
+	FarmerAddress string
+}
+
+// epoch statistics of a batch of consecutive blocks, to be added to the stored ones
+type EpochCounts struct {
+	Stats   map[uint64]*ChiaEpochStats
+	Farmers map[EpochFarmer]uint64
+}
+
+func NewEpochCounts() *EpochCounts {
+	return &EpochCounts{
+		Stats:   make(map[uint64]*ChiaEpochStats),
+		Farmers: make(map[EpochFarmer]uint64),
+	}
+}
+
+// add a block, blocks must be added in height order.
+// difficulty is the weight added by the block, 0 if the previous block is unknown.
+func (c *EpochCounts) Add(block *ChiaBlockRecord, farmerAddress string, difficulty uint64) {
+	epoch := block.Height / EpochBlocks
+	stats, ok := c.Stats[epoch]
+	if !ok {
+		stats = &ChiaEpochStats{Epoch: epoch, StartHeight: block.Height, StartTimestamp: block.BlockTimestamp}
+		c.Stats[epoch] = stats
+	}
+	stats.EndHeight = block.Height
+	if block.BlockTimestamp > stats.EndTimestamp {
+		stats.EndTimestamp = block.BlockTimestamp
+	}
+	if block.BlockTimestamp < stats.StartTimestamp {
+		stats.StartTimestamp = block.BlockTimestamp
+	}
+	// difficulty and sub slot iters change at the first sub slot of an epoch, the latest values are kept
+	if difficulty > 0 {
+		stats.Difficulty = difficulty
+	}
+	stats.SubSlotIters = block.SubSlotIters
+	stats.BlockCount++
+	if block.IsTransactionBlock {
+		stats.TransactionBlockCount++
+	}
+	stats.Fees += block.Fees
+	c.Farmers[EpochFarmer{Epoch: epoch, FarmerAddress: farmerAddress}]++
+}
+
+// add consecutive stored blocks
+func (c *EpochCounts) AddBlocks(blocks []ChiaBlockRecord) {
+	for index := range blocks {
+		difficulty := uint64(0)
+		if index > 0 && blocks[index-1].Height+1 == blocks[index].Height {
+			difficulty = blocks[index].Weight - blocks[index-1].Weight
+		}
+		c.Add(&blocks[index], blocks[index].FarmerAddress, difficulty)
+	}
+}
+
+func (c *EpochCounts) Rows() ([]ChiaEpochStats, []ChiaEpochFarmerBlocks) {
+	stats := make([]ChiaEpochStats, 0, len(c.Stats))
+	for _, epoch := range c.Stats {
+		stats = append(stats, *epoch)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Epoch < stats[j].Epoch })
+	farmers := make([]ChiaEpochFarmerBlocks, 0, len(c.Farmers))
+	for key, count := range c.Farmers {
+		farmers = append(farmers, ChiaEpochFarmerBlocks{FarmerAddress: key.FarmerAddress, Epoch: key.Epoch, BlockCount: count})
+	}
+	sort.Slice(farmers, func(i, j int) bool {
+		if farmers[i].FarmerAddress != farmers[j].FarmerAddress {
+			return farmers[i].FarmerAddress < farmers[j].FarmerAddress
+		}
+		return farmers[i].Epoch < farmers[j].Epoch
+	})
+	return stats, farmers
+}
+
+var mergeEpochStats = clause.OnConflict{
+	DoUpdates: clause.Assignments(map[string]interface{}{
+		"start_height":            gorm.Expr("LEAST(start_height, VALUES(start_height))"),
+		"end_height":              gorm.Expr("GREATEST(end_height, VALUES(end_height))"),
+		"difficulty":              gorm.Expr("IF(VALUES(difficulty) > 0, VALUES(difficulty), difficulty)"),
+		"sub_slot_iters":          gorm.Expr("VALUES(sub_slot_iters)"),
+		"block_count":             gorm.Expr("block_count + VALUES(block_count)"),
+		"transaction_block_count": gorm.Expr("transaction_block_count + VALUES(transaction_block_count)"),
+		"fees":                    gorm.Expr("fees + VALUES(fees)"),
+		"start_timestamp":         gorm.Expr("LEAST(start_timestamp, VALUES(start_timestamp))"),
+		"end_timestamp":           gorm.Expr("GREATEST(end_timestamp, VALUES(end_timestamp))"),
+	}),
+}
+
+// add the counts to the epoch statistics, batches must be applied in height order
+func UpsertEpochStats(counts *EpochCounts, db *gorm.DB) error {
+	if len(counts.Stats) == 0 {
+		return nil
+	}
+	stats, farmers := counts.Rows()
+	r := db.Clauses(mergeEpochStats).Create(&stats)
+	if r.Error != nil {
+		return fmt.Errorf("error upsert epoch stats: %v", r.Error)
+	}
+	r = db.Clauses(increaseBlockCount).Create(&farmers)
+	if r.Error != nil {
+		return fmt.Errorf("error upsert epoch farmer blocks: %v", r.Error)
+	}
+	return nil
+}
+
+// undo the contribution of the blocks above the fork point to the epoch statistics without the stored block records.
+// the epochs above the fork are deleted, the epoch of the fork ends with it.
+func SubtractEpochStats(fork *ChiaBlockRecord, blocks []ChiaBlockRecord, db *gorm.DB) error {
+	counts := NewEpochCounts()
+	for index := range blocks {
+		counts.Add(&blocks[index], blocks[index].FarmerAddress, 0)
+	}
+	forkEpoch := fork.Height / EpochBlocks
+	r := db.Where("epoch > ?", forkEpoch).Delete(&ChiaEpochStats{})
+	if r.Error == nil {
+		r = db.Where("epoch > ?", forkEpoch).Delete(&ChiaEpochFarmerBlocks{})
+	}
+	if r.Error != nil {
+		return fmt.Errorf("error delete rolled back epochs: %v", r.Error)
+	}
+	stats, ok := counts.Stats[forkEpoch]
+	if !ok {
+		return nil
+	}
+	r = db.Model(&ChiaEpochStats{}).Where("epoch = ?", forkEpoch).Updates(map[string]interface{}{
+		"end_height":              fork.Height,
+		"end_timestamp":           fork.BlockTimestamp,
+		"block_count":             gorm.Expr("GREATEST(block_count, ?) - ?", stats.BlockCount, stats.BlockCount),
+		"transaction_block_count": gorm.Expr("GREATEST(transaction_block_count, ?) - ?", stats.TransactionBlockCount, stats.TransactionBlockCount),
+		"fees":                    gorm.Expr("GREATEST(fees, ?) - ?", stats.Fees, stats.Fees),
+	})
+	if r.Error != nil {
+		return fmt.Errorf("error decrease stats of epoch %d: %v", forkEpoch, r.Error)
+	}
+	for key, count := range counts.Farmers {
+		if key.Epoch != forkEpoch {
+			continue
+		}
+		r = db.Model(&ChiaEpochFarmerBlocks{}).Where("farmer_address = ? and epoch = ?", key.FarmerAddress, key.Epoch).
+			Update("block_count", gorm.Expr("GREATEST(block_count, ?) - ?", count, count))
+		if r.Error != nil {
+			return fmt.Errorf("error decrease farmer blocks of epoch %d: %v", forkEpoch, r.Error)
+		}
+	}
+	return nil
+}
+
+// recompute the statistics of [fromEpoch, toEpoch] from the stored block records,
+// used after a chain reorg and to fill epochs synced before the statistics existed
+func RecomputeEpochStats(db *gorm.DB, fromEpoch uint64, toEpoch uint64) error {
+	for epoch := fromEpoch; epoch <= toEpoch; epoch++ {
+		r := db.Where("epoch = ?", epoch).Delete(&ChiaEpochStats{})
+		if r.Error == nil {
+			r = db.Where("epoch = ?", epoch).Delete(&ChiaEpochFarmerBlocks{})
+		}
+		if r.Error != nil {
+			return fmt.Errorf("error delete stats of epoch %d: %v", epoch, r.Error)
+		}
+		var blocks []ChiaBlockRecord
+		r = db.Where("height >= ? and height < ?", epoch*EpochBlocks, (epoch+1)*EpochBlocks).Order("height").Find(&blocks)
+		if r.Error != nil {
+			return fmt.Errorf("error read blocks of epoch %d: %v", epoch, r.Error)
+		}
+		counts := NewEpochCounts()
+		counts.AddBlocks(blocks)
+		err := UpsertEpochStats(counts, db)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type EpochReport struct {
+	ChiaEpochStats
+	TransactionBlockRatio float64 `json:"transaction_block_ratio"`
+	AverageBlockInterval  float64 `json:"average_block_interval"`
+	FarmerBlocks          *uint64 `json:"farmer_blocks,omitempty"`
+	WinRate               float64 `json:"win_rate,omitempty"`
+	WinRateChange         float64 `json:"win_rate_change,omitempty"`
+}
+
+// statistics of [fromEpoch, toEpoch] with the win rate of farmerAddress if it is not empty
+func QueryEpochReports(db *gorm.DB, fromEpoch uint64, toEpoch uint64, farmerAddress string) ([]EpochReport, error) {
+	var stats []ChiaEpochStats
+	r := db.Where("epoch >= ? and epoch <= ?", fromEpoch, toEpoch).Order("epoch").Find(&stats)
+	if r.Error != nil {
+		return nil, fmt.Errorf("error query epoch stats: %v", r.Error)
+	}
+	won := make(map[uint64]uint64)
+	if farmerAddress != "" {
+		var farmers []ChiaEpochFarmerBlocks
+		r = db.Where("farmer_address = ? and epoch >= ? and epoch <= ?", farmerAddress, fromEpoch, toEpoch).Find(&farmers)
+		if r.Error != nil {
+			return nil, fmt.Errorf("error query epoch farmer blocks: %v", r.Error)
+		}
+		for _, farmer := range farmers {
+			won[farmer.Epoch] = farmer.BlockCount
+		}
+	}
+
+	reports := make([]EpochReport, 0, len(stats))
+	for index, epoch := range stats {
+		report := EpochReport{ChiaEpochStats: epoch}
+		if epoch.BlockCount > 0 {
+			report.TransactionBlockRatio = float64(epoch.TransactionBlockCount) / float64(epoch.BlockCount)
+		}
+		if epoch.BlockCount > 1 {
+			report.AverageBlockInterval = float64(epoch.EndTimestamp-epoch.StartTimestamp) / float64(epoch.BlockCount-1)
+		}
+		if farmerAddress != "" {
+			count := won[epoch.Epoch]
+			report.FarmerBlocks = &count
+			if epoch.BlockCount > 0 {
+				report.WinRate = float64(count) / float64(epoch.BlockCount)
+			}
+			if index > 0 && reports[index-1].Epoch+1 == epoch.Epoch {
+				report.WinRateChange = report.WinRate - reports[index-1].WinRate
+			}
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func EpochsAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb)
+	if err != nil {
+		return err
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+	syncHeight, err := GetSyncedHeight(db)
+	if err != nil {
+		return err
+	}
+	if syncHeight == nil {
+		return fmt.Errorf("no synced blocks")
+	}
+	fromEpoch := ctx.Uint64("from-epoch")
+	toEpoch := syncHeight.Height / EpochBlocks
+	if ctx.IsSet("to-epoch") {
+		toEpoch = ctx.Uint64("to-epoch")
+	}
+
+	if ctx.Bool("recompute") {
+		if !config.SyncBlocks {
+			return fmt.Errorf("recompute reads the stored block records, enable sync_blocks")
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			return RecomputeEpochStats(tx, fromEpoch, toEpoch)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	farmerAddress := ctx.String("farmer")
+	reports, err := QueryEpochReports(db, fromEpoch, toEpoch, farmerAddress)
+	if err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(reports)
+	}
+	for _, report := range reports {
+		fmt.Printf("epoch %d (%d-%d): difficulty: %d, sub slot iters: %d, blocks: %d, tx ratio: %.3f, interval: %.1fs, fees: %.6f XCH",
+			report.Epoch, report.StartHeight, report.EndHeight, report.Difficulty, report.SubSlotIters, report.BlockCount,
+			report.TransactionBlockRatio, report.AverageBlockInterval, float64(report.Fees)/CoinUnit["chia"])
+		if report.FarmerBlocks != nil {
+			fmt.Printf(", won: %d, win rate: %.4f%% (%+.4f%%)", *report.FarmerBlocks, report.WinRate*100, report.WinRateChange*100)
+		}
+		fmt.Printf(" \r\n")
+	}
+	return nil
+}
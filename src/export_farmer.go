@@ -5,57 +5,50 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/urfave/cli"
-	"net/http"
-	"os"
-	"os/signal"
 	"time"
 )
 
-func ExportAction(ctx *cli.Context) error {
-	rChannel := make(chan int)
-	signalChannel := make(chan os.Signal)
-	defer close(signalChannel)
-	defer close(rChannel)
+// time between two farmer reports, shortened by the tests
+var exportInterval = time.Duration(5) * time.Second
 
-	config, err := NewConfig(ctx)
+func ExportAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedWallet|NeedHarvester)
 	if err != nil {
 		return err
 	}
-	if config.WalletRpcPort == 0 {
-		return fmt.Errorf("error config: wallet_rpc_port can not be empty")
-	}
 
-	go ExportFarmer(context.Background(), rChannel, config)
-
-	signal.Notify(signalChannel, os.Interrupt)
-	select {
-	case sig := <-signalChannel:
-		fmt.Printf("Got %s signal. Aborting...\n", sig)
-	case code := <-rChannel:
-		fmt.Printf("sync goroutine exit with code: %d\n", code)
-	}
-	return nil
+	return RunService("export", func(runCtx context.Context, channel chan int, heartbeat *Heartbeat) {
+		ExportFarmer(runCtx, channel, NewRuntime(config), heartbeat)
+	})
 }
 
-func ExportFarmer(ctx context.Context, channel chan int, config *Config)  {
-	client, err := RpcClient(config.PrivateCert, config.PrivateKey, config.CaCert)
+// report the farmer every exportInterval until ctx is done, a report is only printed once it is complete
+func ExportFarmer(ctx context.Context, channel chan int, runtime *Runtime, heartbeat *Heartbeat)  {
+	config := runtime.Config
+	client, err := runtime.ChiaClient()
 	if err == nil {
+		heartbeat.Ready("exporting farmer")
 		for {
+			heartbeat.Beat(exportInterval)
 			select {
 			case <-ctx.Done():
 				fmt.Println("shutdown reporter service.")
+				channel <- ExitOK
 				return
-			case <-time.After(time.Duration(5) * time.Second):
+			case <-time.After(exportInterval):
 				{
-					walletStats, err := GetWalletsStats(client, config.RpcHost, config.WalletRpcPort, config.WalletId)
+					walletStats, err := GetWalletsStats(ctx, client.Wallet, config.WalletId)
 					if err != nil {
-						fmt.Printf("error get wallet stats: %v \r\n", err)
+						if ctx.Err() == nil {
+							fmt.Printf("error get wallet stats: %v \r\n", err)
+						}
 						continue
 					}
-					fmt.Printf("%v", walletStats)
-					plotSize ,err := GetPlotSize(client, config.RpcHost, config.HarvesterRpcPort)
+					plotSize ,err := GetPlotSize(ctx, client.Harvesters)
 					if err != nil {
-						fmt.Printf("error get plot size: %v", err)
+						if ctx.Err() == nil {
+							fmt.Printf("error get plot size: %v \r\n", err)
+						}
 						continue
 					}
 					farmer  := Farmer{
@@ -65,65 +58,58 @@ func ExportFarmer(ctx context.Context, channel chan int, config *Config)  {
 						TotalBlockAward: (walletStats.FarmerRewardAmount + walletStats.PoolRewardAmount) / CoinUnit["chia"],
 						BalanceMinerAccount: walletStats.Balance,
 					}
-					fmt.Printf("%v", farmer)
+					fmt.Printf("%v %v \r\n", walletStats, farmer)
 				}
 			}
 		}
 
 	} else {
 		fmt.Printf("error create rcp client: %v \r\n", err)
-		channel <- 1
+		channel <- ExitFailure
 	}
 }
 
-func GetPlotSize(client *http.Client, host string, port uint) (uint64, error) {
-	var result PlotsResponse
-	err := GetPlots(client, host, port, &result)
-	if err != nil {
-		return 0, err
-	}
+// total size of the plots of every harvester
+func GetPlotSize(ctx context.Context, harvesters []*HarvesterClient) (uint64, error) {
 	fileSize := uint64(0)
-	for _, plot := range result.Plots{
-		fileSize += plot.FileSize
+	for _, harvester := range harvesters {
+		result, err := harvester.GetPlots(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("error get plots of %s: %v", harvester.Name(), err)
+		}
+		for _, plot := range result.Plots{
+			fileSize += plot.FileSize
+		}
 	}
 	return fileSize, nil
 }
-func GetPlots(client *http.Client, host string, port uint, result *PlotsResponse) error {
-	url := fmt.Sprintf("https://%s:%d/get_plots?", host, port)
-	data := "{}"
-	return RpcFetch(client, url, data, result)
-}
 
-func GetWalletsStats(client *http.Client, host string, port uint, walletId uint) (*WalletStats, error)  {
-	var walletResponse WalletResponse
-	err := GetWallets(client,host, port, &walletResponse)
+func GetWalletsStats(ctx context.Context, wallet *WalletClient, walletId uint) (*WalletStats, error)  {
+	walletResponse, err := wallet.GetWallets(ctx)
 	if err != nil {
 		return nil, err
 	}
 	balance := float64(0)
-	for _, wallet := range walletResponse.Wallets{
-		if wallet.ID == walletId {
-			var balances Balances
-			err = GetWalletBalance(client, host, port, walletId, &balances)
+	for _, info := range walletResponse.Wallets{
+		if info.ID == walletId {
+			balances, err := wallet.GetWalletBalance(ctx, GetWalletBalanceRequest{WalletId: walletId})
 			if err != nil {
 				return nil, err
 			}
 
-			if wallet.Type == StandWallet {
-				balance = balances.SpendableBalance / CoinUnit["colouredcoin"]
+			if info.Type == StandWallet {
+				balance = balances.WalletBalance.SpendableBalance / CoinUnit["colouredcoin"]
 			} else {
-				balance = balances.SpendableBalance / CoinUnit["chia"]
+				balance = balances.WalletBalance.SpendableBalance / CoinUnit["chia"]
 			}
 			break
 		}
 	}
-	var farmedAmount FarmedAmount
-	err = GetFarmedAmount(client, host, port, &farmedAmount)
+	farmedAmount, err := wallet.GetFarmedAmount(ctx)
 	if err != nil {
 		return nil, err
 	}
-	var walletAddress WalletAddress
-	err = GetNextAddress(client, host, port, walletId, &walletAddress)
+	walletAddress, err := wallet.GetNextAddress(ctx, GetNextAddressRequest{WalletId: walletId, NewAddress: false})
 	if err != nil {
 		return nil, err
 	}
@@ -141,27 +127,3 @@ func GetWalletsStats(client *http.Client, host string, port uint, walletId uint)
 		PoolRewardAmount: farmedAmount.PoolRewardAmount,
 	} ,nil
 }
-
-func GetWallets(client *http.Client, host string, port uint, result *WalletResponse) error {
-	url := fmt.Sprintf("https://%s:%d/get_wallets?", host, port)
-	data := "{}"
-	return RpcFetch(client, url, data, result)
-}
-
-func GetWalletBalance(client *http.Client, host string, port uint, walletId uint, result *Balances) error {
-	url := fmt.Sprintf("https://%s:%d/get_wallet_balance?", host, port)
-	data := fmt.Sprintf(`{"wallet_id": %d}`, walletId)
-	return RpcFetch(client, url, data, result)
-}
-
-func GetFarmedAmount(client *http.Client, host string, port uint, result *FarmedAmount) error {
-	url := fmt.Sprintf("https://%s:%d/get_farmed_amount?", host, port)
-	data := "{}"
-	return RpcFetch(client, url, data, result)
-}
-
-func GetNextAddress(client *http.Client, host string, port uint, walletId uint, result *WalletAddress) error {
-	url := fmt.Sprintf("https://%s:%d/get_next_address?", host, port)
-	data := fmt.Sprintf(`{"wallet_id": %d, "new_address": %t}`, walletId, false)
-	return RpcFetch(client, url, data, result)
-}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// send the lines printed to stdout until the returned function restores it
+func captureStdout(t *testing.T) (<-chan string, func()) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	lines := make(chan string, 100)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			default:
+			}
+		}
+	}()
+	return lines, func() {
+		os.Stdout = stdout
+		writer.Close()
+		<-done
+		reader.Close()
+	}
+}
+
+func TestExportFarmerReplay(t *testing.T) {
+	config := testConfig(t, testReplayConfig, NeedWallet|NeedHarvester)
+	interval := exportInterval
+	exportInterval = 10 * time.Millisecond
+	defer func() {
+		exportInterval = interval
+	}()
+	address, err := EncodePuzzleHash(testFarmerPuzzleHashes[0], "xch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plotSize := uint64(0)
+	for _, size := range testPlotSizes {
+		plotSize += size
+	}
+
+	lines, restore := captureStdout(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	channel := make(chan int, 1)
+	go ExportFarmer(ctx, channel, NewRuntime(config), nil)
+
+	var report string
+	timeout := time.After(5 * time.Second)
+	for report == "" {
+		select {
+		case line := <-lines:
+			if strings.Contains(line, address) {
+				report = line
+			}
+		case <-timeout:
+			cancel()
+			restore()
+			t.Fatal("no farmer report")
+		}
+	}
+	cancel()
+	code := <-channel
+	restore()
+
+	if code != ExitOK {
+		t.Fatalf("export exited with %d", code)
+	}
+	// the farmed rewards are 4 xch and the plots of the harvester are reported as the available power
+	for _, expected := range []string{fmt.Sprintf(" %d ", plotSize), " 4 "} {
+		if !strings.Contains(report, expected) {
+			t.Fatalf("report %q does not contain %q", report, expected)
+		}
+	}
+}
@@ -21,6 +21,7 @@ type Farmer struct {
 }
 
 type FarmedAmount struct {
+	RpcResponse
 	TotalFarmedAmount  float64 `json:"farmed_amount"`
 	PoolRewardAmount   float64 `json:"pool_reward_amount"`
 	FarmerRewardAmount float64 `json:"farmer_reward_amount"`
@@ -29,6 +30,7 @@ type FarmedAmount struct {
 }
 
 type WalletAddress struct {
+	RpcResponse
 	WalletId uint   `json:"wallet_id"`
 	Address  string `json:"address"`
 }
@@ -54,21 +56,28 @@ type Balances struct {
 	MaxSendAmount            float64 `json:"max_send_amount"`
 }
 
+type WalletBalanceResponse struct {
+	RpcResponse
+	WalletBalance Balances `json:"wallet_balance"`
+}
+
 type WalletResponse struct {
+	RpcResponse
 	Wallets []Wallet `json:"wallets"`
 }
 
 type Plot struct {
-	Filename               string `json:"filename"`
-	Size                   uint64 `json:"size"`
-	PlotSeed               uint64 `json:"plot-seed"`
-	PoolPublicKey          string `json:"pool_public_key"`
-	PoolContractPuzzleHash string `json:"pool_contract_puzzle_hash"`
-	PlotPublicKey          string `json:"plot_public_key"`
-	FileSize               uint64 `json:"file_size"`
-	TimeModified           string `json:"time_modified"`
+	Filename               string  `json:"filename"`
+	Size                   uint64  `json:"size"`
+	PlotSeed               string  `json:"plot-seed"`
+	PoolPublicKey          string  `json:"pool_public_key"`
+	PoolContractPuzzleHash string  `json:"pool_contract_puzzle_hash"`
+	PlotPublicKey          string  `json:"plot_public_key"`
+	FileSize               uint64  `json:"file_size"`
+	TimeModified           float64 `json:"time_modified"`
 }
 type PlotsResponse struct {
+	RpcResponse
 	Plots                 []Plot   `json:"plots"`
 	FailedToOpenFileNames []string `json:"failed_to_open_file_names"`
 	NotFoundFilenames     []string `json:"not_found_filenames"`
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// timezone name of the aggregates computed in the process's local time before timezones were configurable
+const LegacyTimezone = "Local"
+
+// the default report timezone, without daylight saving time the hour of a fall-back does not collide with the next one
+const DefaultTimezone = "UTC"
+
+type ReportTimezone struct {
+	Name     string
+	Location *time.Location
+}
+
+type ChiaHourlyFarmerBlocks struct {
+	ID            uint64 `gorm:"primaryKey;<-:false" json:"id"`
+	FarmerAddress string `gorm:"type:varchar(256);not null;uniqueIndex:uk_hfb_farmer_address_hour_tz,priority:1" json:"farmer_address"`
+	BlockCount    uint64 `gorm:"type:bigint(20);not null;"`
+	Hour          string `gorm:"type:datetime;not null;index:idx_hfb_hour;uniqueIndex:uk_hfb_farmer_address_hour_tz,priority:2"`
+	Timezone      string `gorm:"type:varchar(64);not null;default:Local;uniqueIndex:uk_hfb_farmer_address_hour_tz,priority:3" json:"timezone"`
+}
+
+type ChiaWeeklyFarmerBlocks struct {
+	ID            uint64 `gorm:"primaryKey;<-:false" json:"id"`
+	FarmerAddress string `gorm:"type:varchar(256);not null;uniqueIndex:uk_wfb_farmer_address_week_tz,priority:1" json:"farmer_address"`
+	BlockCount    uint64 `gorm:"type:bigint(20);not null;"`
+	Week          string `gorm:"type:date;not null;index:idx_wfb_week;uniqueIndex:uk_wfb_farmer_address_week_tz,priority:2"`
+	Timezone      string `gorm:"type:varchar(64);not null;default:Local;uniqueIndex:uk_wfb_farmer_address_week_tz,priority:3" json:"timezone"`
+}
+
+type ChiaMonthlyFarmerBlocks struct {
+	ID            uint64 `gorm:"primaryKey;<-:false" json:"id"`
+	FarmerAddress string `gorm:"type:varchar(256);not null;uniqueIndex:uk_mfb_farmer_address_month_tz,priority:1" json:"farmer_address"`
+	BlockCount    uint64 `gorm:"type:bigint(20);not null;"`
+	Month         string `gorm:"type:date;not null;index:idx_mfb_month;uniqueIndex:uk_mfb_farmer_address_month_tz,priority:2"`
+	Timezone      string `gorm:"type:varchar(64);not null;default:Local;uniqueIndex:uk_mfb_farmer_address_month_tz,priority:3" json:"timezone"`
+}
+
+// a time granularity of the won blocks aggregates, periods are labeled by their first moment
+type Granularity struct {
+	Name     string
+	Column   string
+	Layout   string
+	Model    interface{}
+	Truncate func(t time.Time) time.Time
+	Next     func(t time.Time) time.Time
+}
+
+var Granularities = []*Granularity{
+	{
+		Name:   "hourly",
+		Column: "hour",
+		Layout: "2006-01-02 15:00:00",
+		Model:  &ChiaHourlyFarmerBlocks{},
+		Truncate: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+		},
+		Next: func(t time.Time) time.Time { return t.Add(time.Hour) },
+	},
+	{
+		Name:   "daily",
+		Column: "day",
+		Layout: "2006-01-02",
+		Model:  &ChiaDailyFarmerBlocks{},
+		Truncate: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		},
+		Next: func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+	},
+	{
+		// weeks start on monday
+		Name:   "weekly",
+		Column: "week",
+		Layout: "2006-01-02",
+		Model:  &ChiaWeeklyFarmerBlocks{},
+		Truncate: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day()-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+		},
+		Next: func(t time.Time) time.Time { return t.AddDate(0, 0, 7) },
+	},
+	{
+		Name:   "monthly",
+		Column: "month",
+		Layout: "2006-01-02",
+		Model:  &ChiaMonthlyFarmerBlocks{},
+		Truncate: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		},
+		Next: func(t time.Time) time.Time { return t.AddDate(0, 1, 0) },
+	},
+}
+
+// label of the period containing timestamp
+func (g *Granularity) Period(timestamp uint64, location *time.Location) string {
+	return g.Truncate(time.Unix(int64(timestamp), 0).In(location)).Format(g.Layout)
+}
+
+// timestamps of the first and the last second of the periods containing from and to
+func (g *Granularity) Bounds(from uint64, to uint64, location *time.Location) (uint64, uint64) {
+	first := g.Truncate(time.Unix(int64(from), 0).In(location))
+	last := g.Next(g.Truncate(time.Unix(int64(to), 0).In(location)))
+	return uint64(first.Unix()), uint64(last.Unix()) - 1
+}
+
+func LoadReportTimezones(names []string) ([]ReportTimezone, error) {
+	if len(names) == 0 {
+		names = []string{DefaultTimezone}
+	}
+	timezones := make([]ReportTimezone, 0, len(names))
+	for _, name := range names {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, fmt.Errorf("error config: invalid report timezone %s: %v", name, err)
+		}
+		if name == LegacyTimezone {
+			fmt.Printf("report timezone %s follows the daylight saving time of the process, the repeated hour of a fall-back is counted in one row, prefer an IANA timezone \r\n", name)
+		}
+		timezones = append(timezones, ReportTimezone{Name: name, Location: location})
+	}
+	return timezones, nil
+}
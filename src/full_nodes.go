@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// how often the full nodes are probed to find a healthier one
+const fullNodeProbeInterval = 60 * time.Second
+
+// how many blocks the current full node may lag behind the best one before sync switches
+const fullNodeMaxLag = 3
+
+// a full node whose blocks differ from another one is not selected or used for checks for this long
+const fullNodeExclusion = 10 * time.Minute
+
+// full nodes may briefly disagree on the blocks this close to their peak, a node is not excluded for them
+const crossCheckConfirmations = 32
+
+// health of a full node reported by get_blockchain_state
+type FullNodeStatus struct {
+	Node   *FullNodeClient
+	Peak   uint64
+	Synced bool
+	Err    error
+}
+
+// header hash of a block which differs between two full nodes
+type ChiaHeaderHashMismatch struct {
+	ID              uint64    `gorm:"primaryKey;<-:false" json:"id"`
+	Height          uint64    `gorm:"type:bigint(20);not null;index:idx_hhm_height" json:"height"`
+	Node            string    `gorm:"type:varchar(256);not null;default:''" json:"node"`
+	HeaderHash      string    `gorm:"type:varchar(256);not null;default:''" json:"header_hash"`
+	CheckNode       string    `gorm:"type:varchar(256);not null;default:''" json:"check_node"`
+	CheckHeaderHash string    `gorm:"type:varchar(256);not null;default:''" json:"check_header_hash"`
+	CreatedAt       time.Time `gorm:"index:idx_hhm_created_at" json:"created_at"`
+}
+
+// the configured full nodes, sync reads from the current one and fails over to the healthiest other one.
+// the pool is shared by the components of run, mu guards the selection.
+type FullNodePool struct {
+	Nodes    []*FullNodeClient
+	mu       sync.Mutex
+	current  *FullNodeClient
+	statuses []FullNodeStatus
+	probed   time.Time
+	excluded map[*FullNodeClient]time.Time
+}
+
+func NewFullNodePool(config *Config) (*FullNodePool, error) {
+	return newFullNodePool(config, config.RpcClient)
+}
+
+// pool of the configured full nodes with the rpc clients created by newClient
+func newFullNodePool(config *Config, newClient func(certFile string, keyFile string, caFile string) (*http.Client, error)) (*FullNodePool, error) {
+	pool := &FullNodePool{}
+	for _, nodeConfig := range config.FullNodes {
+		endpoint, err := newServiceEndpoint(config, nodeConfig, newClient)
+		if err != nil {
+			return nil, err
+		}
+		pool.Nodes = append(pool.Nodes, &FullNodeClient{endpoint})
+	}
+	return pool, nil
+}
+
+// query every full node concurrently, statuses are ordered from the healthiest:
+// reachable before unreachable, synced before syncing, higher peak first, then in configured order.
+// the nodes are queried without holding mu, so the other components of run are not blocked meanwhile.
+func (p *FullNodePool) Probe(ctx context.Context) []FullNodeStatus {
+	p.mu.Lock()
+	nodes := append([]*FullNodeClient(nil), p.Nodes...)
+	p.mu.Unlock()
+	statuses := probeNodes(ctx, nodes)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.statuses = statuses
+	p.probed = time.Now()
+	return statuses
+}
+
+func probeNodes(ctx context.Context, nodes []*FullNodeClient) []FullNodeStatus {
+	statuses := make([]FullNodeStatus, len(nodes))
+	var wg sync.WaitGroup
+	for index, node := range nodes {
+		wg.Add(1)
+		go func(index int, node *FullNodeClient) {
+			defer wg.Done()
+			status := FullNodeStatus{Node: node}
+			result, err := node.GetBlockchainState(ctx)
+			status.Err = err
+			if status.Err == nil && result.BlockchainState.Peak == nil {
+				status.Err = fmt.Errorf("full node has no peak")
+			}
+			if status.Err == nil {
+				status.Peak = result.BlockchainState.Peak.Height
+				status.Synced = result.BlockchainState.Sync.Synced
+			}
+			statuses[index] = status
+		}(index, node)
+	}
+	wg.Wait()
+	sort.SliceStable(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+		if (a.Err == nil) != (b.Err == nil) {
+			return a.Err == nil
+		}
+		if a.Synced != b.Synced {
+			return a.Synced
+		}
+		return a.Peak > b.Peak
+	})
+	return statuses
+}
+
+// probe the full nodes and keep the current one unless it is unreachable or lags behind the healthiest one
+func (p *FullNodePool) Select(ctx context.Context) (*FullNodeClient, error) {
+	statuses := p.Probe(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.selectNode(statuses)
+}
+
+func (p *FullNodePool) selectNode(statuses []FullNodeStatus) (*FullNodeClient, error) {
+	if len(statuses) == 0 {
+		return nil, fmt.Errorf("no full node configured, set full_node_rpc_port or full_nodes")
+	}
+	best := statuses[0]
+	for _, status := range statuses {
+		// the excluded nodes are only used when no other node is reachable
+		if status.Err == nil && !p.isExcluded(status.Node) {
+			best = status
+			break
+		}
+	}
+	if best.Err != nil {
+		return nil, fmt.Errorf("no full node reachable, %s: %v", best.Node.Name(), best.Err)
+	}
+	for _, status := range statuses {
+		if status.Node == p.current && status.Err == nil && status.Synced == best.Synced && status.Peak+fullNodeMaxLag >= best.Peak {
+			return p.current, nil
+		}
+	}
+	if p.current != nil {
+		fmt.Printf("switch full node from %s to %s, peak: %d, synced: %v \r\n", p.current.Name(), best.Node.Name(), best.Peak, best.Synced)
+	} else if !best.Synced {
+		fmt.Printf("no synced full node, use %s at peak %d \r\n", best.Node.Name(), best.Peak)
+	}
+	p.current = best.Node
+	return p.current, nil
+}
+
+// the current full node, probed again every fullNodeProbeInterval
+func (p *FullNodePool) Node(ctx context.Context) (*FullNodeClient, error) {
+	p.mu.Lock()
+	current := p.current
+	probed := p.probed
+	p.mu.Unlock()
+	if current != nil && time.Since(probed) < fullNodeProbeInterval {
+		return current, nil
+	}
+	return p.Select(ctx)
+}
+
+// give up the current full node after an error and select the healthiest one, which may be the same node
+func (p *FullNodePool) Failover(ctx context.Context) (*FullNodeClient, error) {
+	p.mu.Lock()
+	p.current = nil
+	p.mu.Unlock()
+	return p.Select(ctx)
+}
+
+// give up node, whose blocks differ from the other full nodes, and select the healthiest one other than it.
+// node is not selected again or used to check the blocks of other nodes for fullNodeExclusion.
+func (p *FullNodePool) Exclude(ctx context.Context, node *FullNodeClient) (*FullNodeClient, error) {
+	p.mu.Lock()
+	if p.excluded == nil {
+		p.excluded = make(map[*FullNodeClient]time.Time)
+	}
+	p.excluded[node] = time.Now().Add(fullNodeExclusion)
+	fmt.Printf("exclude full node %s for %s \r\n", node.Name(), fullNodeExclusion)
+	if p.current == node {
+		p.current = nil
+	}
+	p.mu.Unlock()
+	return p.Select(ctx)
+}
+
+func (p *FullNodePool) isExcluded(node *FullNodeClient) bool {
+	until, ok := p.excluded[node]
+	if ok && time.Now().After(until) {
+		delete(p.excluded, node)
+		return false
+	}
+	return ok
+}
+
+// the statuses of the reachable full nodes other than node and the excluded ones, from the healthiest
+func (p *FullNodePool) CheckNodes(node *FullNodeClient) []FullNodeStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var checks []FullNodeStatus
+	for _, status := range p.statuses {
+		if status.Err == nil && status.Node != node && !p.isExcluded(status.Node) {
+			checks = append(checks, status)
+		}
+	}
+	return checks
+}
+
+// compare the header hashes of blocks with the same heights on another full node.
+// heights the other node has not reached yet are not compared.
+func CrossCheckBlocks(ctx context.Context, node *FullNodeClient, check *FullNodeClient, blocks []ChiaBlockRecord) ([]ChiaHeaderHashMismatch, error) {
+	start, end := blocks[0].Height, blocks[len(blocks)-1].Height+1
+	result, err := check.GetBlockRecords(ctx, GetBlockRecordsRequest{Start: start, End: end})
+	if err != nil {
+		return nil, err
+	}
+	checked := make(map[uint64]string, len(result.BlockRecords))
+	for _, block := range result.BlockRecords {
+		checked[block.Height] = block.HeaderHash
+	}
+	var mismatches []ChiaHeaderHashMismatch
+	for _, block := range blocks {
+		headerHash, ok := checked[block.Height]
+		if ok && headerHash != block.HeaderHash {
+			mismatches = append(mismatches, ChiaHeaderHashMismatch{
+				Height:          block.Height,
+				Node:            node.Name(),
+				HeaderHash:      block.HeaderHash,
+				CheckNode:       check.Name(),
+				CheckHeaderHash: headerHash,
+			})
+		}
+	}
+	return mismatches, nil
+}
+
+// record the mismatches which are not recorded yet for the height and the two nodes
+func LogHeaderHashMismatches(mismatches []ChiaHeaderHashMismatch, db *gorm.DB) error {
+	for index := range mismatches {
+		mismatch := &mismatches[index]
+		var recorded ChiaHeaderHashMismatch
+		r := db.Where("height = ? and node = ? and check_node = ?", mismatch.Height, mismatch.Node, mismatch.CheckNode).Limit(1).Find(&recorded)
+		if r.Error != nil {
+			return fmt.Errorf("error read header hash mismatches: %v", r.Error)
+		}
+		if r.RowsAffected > 0 {
+			continue
+		}
+		fmt.Printf("header hash mismatch at height %d, %s: %s, %s: %s \r\n", mismatch.Height,
+			mismatch.Node, mismatch.HeaderHash, mismatch.CheckNode, mismatch.CheckHeaderHash)
+		r = db.Create(mismatch)
+		if r.Error != nil {
+			return fmt.Errorf("error log header hash mismatches: %v", r.Error)
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ go 1.16
 
 require (
 	github.com/adiabat/bech32 v0.0.0-20170505011816-6289d404861d // indirect
+	github.com/gorilla/websocket v1.4.2
 	github.com/spf13/viper v1.7.1
 	github.com/urfave/cli v1.22.5
 	gorm.io/driver/mysql v1.1.0
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"math"
+	"sort"
+	"time"
+)
+
+const DefaultIntegrityCheckInterval = 3600
+
+// cursor of the integrity checker, the stored blocks up to it have been checked
+const CursorIntegrity = "integrity"
+const integrityBatch = 10000
+const integrityRestoreBatch = 1000
+
+// heights of [from, to] stored more than once
+func DuplicateHeights(db *gorm.DB, from uint64, to uint64) ([]uint64, error) {
+	var heights []uint64
+	r := db.Model(&ChiaBlockRecord{}).Where("height >= ? and height <= ?", from, to).
+		Group("height").Having("count(*) > 1").Order("height").Pluck("height", &heights)
+	if r.Error != nil {
+		return nil, fmt.Errorf("error find duplicated heights: %v", r.Error)
+	}
+	return heights, nil
+}
+
+// keep the latest stored block of each height and delete the others,
+// their contribution is subtracted from the aggregates. returns the number of deleted blocks.
+func DeleteDuplicateBlocks(db *gorm.DB, config *Config, heights []uint64) (int, error) {
+	if len(heights) == 0 {
+		return 0, nil
+	}
+	deleted := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var stored []ChiaBlockRecord
+		r := tx.Where("height in ?", heights).Order("height, id desc").Find(&stored)
+		if r.Error != nil {
+			return fmt.Errorf("error read duplicated blocks: %v", r.Error)
+		}
+		var ids []uint64
+		epochs := make(map[uint64]bool)
+		counts := NewFarmerBlockCounts(config.ReportTimezones)
+		for index, block := range stored {
+			if index == 0 || stored[index-1].Height != block.Height {
+				continue
+			}
+			ids = append(ids, block.ID)
+			epochs[block.Height/EpochBlocks] = true
+			counts.Add(block.FarmerAddress, block.BlockTimestamp)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		err := SubtractFarmerBlocks(counts, tx)
+		if err != nil {
+			return err
+		}
+		r = tx.Where("id in ?", ids).Delete(&ChiaBlockRecord{})
+		if r.Error != nil {
+			return fmt.Errorf("error delete duplicated blocks: %v", r.Error)
+		}
+		// watchlist mode only stores the watched blocks, the statistics can not be recomputed from them
+		if config.SyncBlocks {
+			for epoch := range epochs {
+				err = RecomputeEpochStats(tx, epoch, epoch)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		deleted = len(ids)
+		return nil
+	})
+	return deleted, err
+}
+
+// delete the duplicated block records so the unique key on height can be created
+func DeduplicateBlockRecords(db *gorm.DB, config *Config) error {
+	heights, err := DuplicateHeights(db, 0, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(heights); start += integrityRestoreBatch {
+		end := start + integrityRestoreBatch
+		if end > len(heights) {
+			end = len(heights)
+		}
+		deleted, err := DeleteDuplicateBlocks(db, config, heights[start:end])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("deleted %d duplicated block records between height %d and %d \r\n", deleted, heights[start], heights[end-1])
+	}
+	if db.Migrator().HasIndex(&ChiaBlockRecord{}, "idx_bc_height") {
+		err = db.Migrator().DropIndex(&ChiaBlockRecord{}, "idx_bc_height")
+		if err != nil {
+			return fmt.Errorf("error drop index idx_bc_height: %v", err)
+		}
+	}
+	return nil
+}
+
+// spans of [start, end) not in the sorted heights
+func missingSpans(heights []uint64, start uint64, end uint64) [][2]uint64 {
+	var spans [][2]uint64
+	next := start
+	for _, height := range heights {
+		if height > next {
+			spans = append(spans, [2]uint64{next, height - 1})
+		}
+		if height >= next {
+			next = height + 1
+		}
+	}
+	if next < end {
+		spans = append(spans, [2]uint64{next, end - 1})
+	}
+	return spans
+}
+
+// fetch and store the missing blocks of [from, to]. the aggregates are left untouched, they were counted when the batch
+// of the blocks was synced, except for the quarantined blocks which are counted and released. returns the number of restored blocks.
+func RestoreMissingBlocks(ctx context.Context, node *FullNodeClient, config *Config, db *gorm.DB, from uint64, to uint64) (int, error) {
+	syncHeight, err := GetSyncedHeight(db)
+	if err != nil {
+		return 0, err
+	}
+	if syncHeight == nil || to+config.MaxReorgDepth > syncHeight.Height {
+		return 0, fmt.Errorf("height %d is within max_reorg_depth of the synced height", to)
+	}
+	blocks, _, err := fetchSyncedRange(ctx, node, db, from, to, syncHeight)
+	if err != nil {
+		return 0, err
+	}
+	_, _, err = CountBlockRecords(blocks, nil, config)
+	if err != nil {
+		return 0, err
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// a chain reorg rolls back at most max_reorg_depth blocks, the lock keeps it from reaching the range meanwhile
+		var cursor ChiaBlockSyncHeight
+		r := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", CursorBlocks).Take(&cursor)
+		if r.Error != nil {
+			return fmt.Errorf("error lock sync height: %v", r.Error)
+		}
+		if to+config.MaxReorgDepth > cursor.Height {
+			return fmt.Errorf("blocks were rolled back during the restore, check again later")
+		}
+		r = tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&blocks, resyncBatch)
+		if r.Error != nil {
+			return fmt.Errorf("error save block records: %v", r.Error)
+		}
+		err := RecomputeEpochStats(tx, from/EpochBlocks, to/EpochBlocks)
+		if err != nil {
+			return err
+		}
+		// quarantined blocks were skipped by the aggregates and the derived pipelines, they are counted and released
+		quarantined, err := QuarantinedHeights(tx, from, to)
+		if err != nil || len(quarantined) == 0 {
+			return err
+		}
+		r = tx.Where("height >= ? and height <= ?", from, to).Delete(&ChiaQuarantinedBlock{})
+		if r.Error != nil {
+			return fmt.Errorf("error release quarantined blocks: %v", r.Error)
+		}
+		released := make(map[uint64]bool, len(quarantined))
+		for _, height := range quarantined {
+			released[height] = true
+		}
+		counts := NewFarmerBlockCounts(config.ReportTimezones)
+		for _, block := range blocks {
+			if released[block.Height] {
+				counts.Add(block.FarmerAddress, block.BlockTimestamp)
+			}
+		}
+		err = UpsertFarmerBlocks(counts, tx)
+		if err != nil {
+			return err
+		}
+		return ResetCursors(quarantined[0], config, tx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(blocks), nil
+}
+
+// check the stored blocks after the integrity cursor up to max_reorg_depth below the synced height,
+// restore the missing heights and delete the duplicated ones. returns the numbers of restored and deleted blocks.
+func CheckIntegrity(ctx context.Context, node *FullNodeClient, config *Config, db *gorm.DB) (int, int, error) {
+	syncHeight, err := GetSyncedHeight(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	if syncHeight == nil || syncHeight.Height < config.MaxReorgDepth {
+		return 0, 0, nil
+	}
+	last := syncHeight.Height - config.MaxReorgDepth
+	cursor, err := GetCursor(db, CursorIntegrity)
+	if err != nil {
+		return 0, 0, err
+	}
+	start := uint64(0)
+	if cursor != nil {
+		start = cursor.Height + 1
+	}
+
+	restored, deleted := 0, 0
+	for start <= last {
+		end := start + integrityBatch
+		if end > last+1 {
+			end = last + 1
+		}
+		var heights []uint64
+		r := db.Model(&ChiaBlockRecord{}).Where("height >= ? and height < ?", start, end).Order("height").Pluck("height", &heights)
+		if r.Error != nil {
+			return restored, deleted, fmt.Errorf("error read stored heights: %v", r.Error)
+		}
+		var duplicates []uint64
+		for index := 1; index < len(heights); index++ {
+			if heights[index] == heights[index-1] && (len(duplicates) == 0 || duplicates[len(duplicates)-1] != heights[index]) {
+				duplicates = append(duplicates, heights[index])
+			}
+		}
+		count, err := DeleteDuplicateBlocks(db, config, duplicates)
+		if err != nil {
+			return restored, deleted, err
+		}
+		deleted += count
+		// quarantined blocks are missing on purpose, they are released by quarantine retry
+		quarantined, err := QuarantinedHeights(db, start, end-1)
+		if err != nil {
+			return restored, deleted, err
+		}
+		heights = append(heights, quarantined...)
+		sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+		for _, span := range missingSpans(heights, start, end) {
+			for from := span[0]; from <= span[1]; from += integrityRestoreBatch {
+				to := from + integrityRestoreBatch - 1
+				if to > span[1] {
+					to = span[1]
+				}
+				fmt.Printf("restore missing blocks %d-%d \r\n", from, to)
+				count, err := RestoreMissingBlocks(ctx, node, config, db, from, to)
+				if err != nil {
+					return restored, deleted, fmt.Errorf("error restore blocks %d-%d: %w", from, to, err)
+				}
+				restored += count
+			}
+		}
+		var checked ChiaBlockRecord
+		r = db.Where("height = ?", end-1).Limit(1).Find(&checked)
+		if r.Error != nil {
+			return restored, deleted, fmt.Errorf("error read block %d: %v", end-1, r.Error)
+		}
+		checked.Height = end - 1
+		err = SetCursor(db, CursorIntegrity, checked.Height, checked.HeaderHash)
+		if err != nil {
+			return restored, deleted, err
+		}
+		start = end
+	}
+	return restored, deleted, nil
+}
+
+// run the integrity checker every interval until ctx is done, requires sync_blocks
+func RunIntegrityChecks(ctx context.Context, config *Config, db *gorm.DB, pool *FullNodePool, interval time.Duration) {
+	for {
+		node, err := pool.Node(ctx)
+		if err == nil {
+			restored, deleted, err := CheckIntegrity(ctx, node, config, db)
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("error check integrity of block records: %v \r\n", err)
+				// the pool is shared with sync, only a full node which is down is given up
+				if IsRpcServiceDown(err) {
+					pool.Failover(ctx)
+				}
+			}
+			if restored > 0 || deleted > 0 {
+				fmt.Printf("integrity check restored %d missing blocks and deleted %d duplicated blocks \r\n", restored, deleted)
+				totals, err := VerifyFarmerTotals(db)
+				if err != nil {
+					fmt.Printf("%v \r\n", err)
+				} else if len(totals) > 0 {
+					fmt.Printf("total blocks of %d farmers differ from the stored blocks, stop sync and run rebuild \r\n", len(totals))
+				}
+			}
+		} else if ctx.Err() == nil {
+			fmt.Printf("error select full node: %v \r\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMissingSpans(t *testing.T) {
+	cases := []struct {
+		name     string
+		heights  []uint64
+		start    uint64
+		end      uint64
+		expected [][2]uint64
+	}{
+		{"complete", []uint64{10, 11, 12, 13}, 10, 14, nil},
+		{"empty", nil, 10, 14, [][2]uint64{{10, 13}}},
+		{"gap in the middle", []uint64{10, 11, 14, 15}, 10, 16, [][2]uint64{{12, 13}}},
+		{"missing edges", []uint64{12, 13}, 10, 16, [][2]uint64{{10, 11}, {14, 15}}},
+		{"single heights", []uint64{10, 12, 14}, 10, 15, [][2]uint64{{11, 11}, {13, 13}}},
+		{"duplicated heights", []uint64{10, 11, 11, 13}, 10, 14, [][2]uint64{{12, 12}}},
+	}
+	for _, c := range cases {
+		spans := missingSpans(c.heights, c.start, c.end)
+		if !reflect.DeepEqual(spans, c.expected) {
+			t.Errorf("%s: spans %v, expected %v", c.name, spans, c.expected)
+		}
+	}
+}
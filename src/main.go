@@ -36,17 +36,490 @@ var vExportCommand = cli.Command{
 	},
 }
 
+var vBackfillCommand = cli.Command{
+	Name:  "backfill",
+	Usage: "sync historical blocks with parallel workers up to the peak or a given height",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "set config file(json format)",
+		},
+		cli.UintFlag{
+			Name:  "workers",
+			Usage: "number of workers fetching blocks, overrides backfill_workers",
+		},
+		cli.Uint64Flag{
+			Name:  "range-size",
+			Usage: "number of blocks fetched by one request, overrides backfill_range_size",
+		},
+		cli.Uint64Flag{
+			Name:  "max-in-flight",
+			Usage: "max number of fetched blocks waiting to be committed, overrides backfill_max_in_flight",
+		},
+		cli.Uint64Flag{
+			Name:  "to",
+			Usage: "stop at this height instead of the peak",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return BackfillAction(c)
+	},
+}
+
+var vRebuildCommand = cli.Command{
+	Name:  "rebuild",
+	Usage: "recompute total/daily won blocks from the stored block records",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "set config file(json format)",
+		},
+		cli.Uint64Flag{
+			Name:  "from-height",
+			Usage: "rebuild the days covered by blocks from this height",
+		},
+		cli.Uint64Flag{
+			Name:  "to-height",
+			Usage: "rebuild the days covered by blocks up to this height, default the synced height",
+		},
+		cli.StringFlag{
+			Name:  "from-day",
+			Usage: "rebuild daily blocks from this day(yyyy-mm-dd)",
+		},
+		cli.StringFlag{
+			Name:  "to-day",
+			Usage: "rebuild daily blocks up to this day(yyyy-mm-dd)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return RebuildAction(c)
+	},
+}
+
+var vCollectStateCommand = cli.Command{
+	Name:  "collect-state",
+	Usage: "record network state snapshots of the full node periodically",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "set config file(json format)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return CollectStateAction(c)
+	},
+}
+
+var vQueryStateCommand = cli.Command{
+	Name:  "query-state",
+	Usage: "list network state snapshots of a time range",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "set config file(json format)",
+		},
+		cli.StringFlag{
+			Name:  "from",
+			Usage: "start time(yyyy-mm-dd [hh:mm:ss]), default 24 hours before to",
+		},
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "end time(yyyy-mm-dd [hh:mm:ss]), default now",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print as json",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return QueryStateAction(c)
+	},
+}
+
+var vEstimateSpaceCommand = cli.Command{
+	Name:  "estimate-space",
+	Usage: "estimate the space of farmers from their share of won blocks and the network space",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "set config file(json format)",
+		},
+		cli.StringFlag{
+			Name:  "farmer",
+			Usage: "farmer address, default every farmer who won blocks in the window",
+		},
+		cli.StringFlag{
+			Name:  "day",
+			Usage: "last day of the windows(yyyy-mm-dd), default yesterday",
+		},
+		cli.StringFlag{
+			Name:  "windows",
+			Value: "1,7,30",
+			Usage: "comma separated window sizes in days",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print as json",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return EstimateSpaceAction(c)
+	},
+}
+
+var vFixTimestampsCommand = cli.Command{
+	Name:  "fix-timestamps",
+	Usage: "interpolate the timestamps of stored non transaction blocks and move their daily counts to the right day",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "set config file(json format)",
+		},
+		cli.Uint64Flag{
+			Name:  "from-height",
+			Usage: "first height to fix",
+		},
+		cli.Uint64Flag{
+			Name:  "to-height",
+			Usage: "last height to fix, default the synced height",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return FixTimestampsAction(c)
+	},
+}
+
+var vCursorsCommand = cli.Command{
+	Name:  "cursors",
+	Usage: "list the sync cursors and how far they lag behind block ingestion and the peak",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "set config file(json format)",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the cursors as json",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return CursorsAction(c)
+	},
+}
+
+var vEpochsCommand = cli.Command{
+	Name:  "epochs",
+	Usage: "list difficulty, sub slot iters, blocks, fees and a farmer's win rate per epoch",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "set config file(json format)",
+		},
+		cli.Uint64Flag{
+			Name:  "from-epoch",
+			Usage: "first epoch to list",
+		},
+		cli.Uint64Flag{
+			Name:  "to-epoch",
+			Usage: "last epoch to list, default the epoch of the synced height",
+		},
+		cli.StringFlag{
+			Name:  "farmer",
+			Usage: "farmer address to show the win rate of",
+		},
+		cli.BoolFlag{
+			Name:  "recompute",
+			Usage: "recompute the listed epochs from the stored block records first, requires sync_blocks",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the epochs as json",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return EpochsAction(c)
+	},
+}
+
+var vWatchlistCommand = cli.Command{
+	Name:  "watchlist",
+	Usage: "manage the watched farmer and pool addresses of watchlist_mode",
+	Subcommands: []cli.Command{
+		{
+			Name:  "list",
+			Usage: "list the watched addresses of the config and the watchlist table",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config",
+					Value: "",
+					Usage: "set config file(json format)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return WatchlistListAction(c)
+			},
+		},
+		{
+			Name:      "add",
+			Usage:     "add addresses or puzzle hashes to the watchlist table",
+			ArgsUsage: "ADDRESS|PUZZLE_HASH...",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config",
+					Value: "",
+					Usage: "set config file(json format)",
+				},
+				cli.StringFlag{
+					Name:  "note",
+					Usage: "note of the addresses",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return WatchlistAddAction(c)
+			},
+		},
+		{
+			Name:      "remove",
+			Usage:     "remove addresses or puzzle hashes from the watchlist table",
+			ArgsUsage: "ADDRESS|PUZZLE_HASH...",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config",
+					Value: "",
+					Usage: "set config file(json format)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return WatchlistRemoveAction(c)
+			},
+		},
+	},
+}
+
+var vResyncCommand = cli.Command{
+	Name:  "resync",
+	Usage: "fetch a synced height range again and replace its block records and their contribution to the aggregates",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "set config file(json format)",
+		},
+		cli.Uint64Flag{
+			Name:  "from",
+			Usage: "first height to resync",
+		},
+		cli.Uint64Flag{
+			Name:  "to",
+			Usage: "last height to resync",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return ResyncAction(c)
+	},
+}
+
+var vVerifyCommand = cli.Command{
+	Name:  "verify",
+	Usage: "compare the stored block records and farmer totals with the full node",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "set config file(json format)",
+		},
+		cli.Uint64Flag{
+			Name:  "from",
+			Usage: "first height to verify",
+		},
+		cli.Uint64Flag{
+			Name:  "to",
+			Usage: "last height to verify, default the synced height",
+		},
+		cli.IntFlag{
+			Name:  "sample",
+			Usage: "verify this many random heights of the range instead of every height",
+		},
+		cli.BoolFlag{
+			Name:  "repair",
+			Usage: "resync the heights with issues and rebuild the aggregates if the farmer totals still differ",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the report as json",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return VerifyAction(c)
+	},
+}
+
+var vQuarantineCommand = cli.Command{
+	Name:  "quarantine",
+	Usage: "manage the blocks sync could not process",
+	Subcommands: []cli.Command{
+		{
+			Name:  "list",
+			Usage: "list the quarantined blocks with the reason",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config",
+					Value: "",
+					Usage: "set config file(json format)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return QuarantineListAction(c)
+			},
+		},
+		{
+			Name:  "retry",
+			Usage: "process the quarantined blocks again and release the ones which succeed",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config",
+					Value: "",
+					Usage: "set config file(json format)",
+				},
+				cli.Uint64Flag{
+					Name:  "height",
+					Usage: "only retry the block of this height",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return QuarantineRetryAction(c)
+			},
+		},
+	},
+}
+
+var vRunCommand = cli.Command{
+	Name:  "run",
+	Usage: "run the enabled components in one process and restart the crashed ones",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "set config file(json format)",
+		},
+		cli.StringFlag{
+			Name:  "components",
+			Usage: "comma separated components to run instead of run_components, one of sync, export and collect-state",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return RunAction(c)
+	},
+}
+
+var vRpcBreakersCommand = cli.Command{
+	Name:  "rpc-breakers",
+	Usage: "list the circuit breaker state of every chia service the running services call",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "set config file(json format)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return RpcBreakersAction(c)
+	},
+}
+
+var vConfigCommand = cli.Command{
+	Name:  "config",
+	Usage: "generate a config from the chia config.yaml of this machine",
+	Subcommands: []cli.Command{
+		{
+			Name:  "discover",
+			Usage: "print the config discovered from the chia root",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "chia-root",
+					Usage: "chia root directory, defaults to CHIA_ROOT or ~/.chia/mainnet",
+				},
+				cli.StringFlag{
+					Name:  "dsn",
+					Usage: "dsn of the database written to the config",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return ConfigDiscoverAction(c)
+			},
+		},
+		{
+			Name:  "init",
+			Usage: "write the config discovered from the chia root to a file",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "chia-root",
+					Usage: "chia root directory, defaults to CHIA_ROOT or ~/.chia/mainnet",
+				},
+				cli.StringFlag{
+					Name:  "dsn",
+					Usage: "dsn of the database written to the config",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Value: "config.json",
+					Usage: "config file to write",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "overwrite an existing config file",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return ConfigInitAction(c)
+			},
+		},
+	},
+}
+
 func main() {
 	local := []cli.Command{
+		vRunCommand,
 		vSyncCommand,
 		vExportCommand,
+		vBackfillCommand,
+		vRebuildCommand,
+		vCollectStateCommand,
+		vQueryStateCommand,
+		vEstimateSpaceCommand,
+		vFixTimestampsCommand,
+		vCursorsCommand,
+		vEpochsCommand,
+		vWatchlistCommand,
+		vResyncCommand,
+		vVerifyCommand,
+		vQuarantineCommand,
+		vRpcBreakersCommand,
+		vConfigCommand,
 	}
 
 	app := &cli.App{
 		Name:     "chia-blocks-sync",
 		Version:  "1.0",
 		Commands: local,
-		Flags:    []cli.Flag{},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "rpc-record",
+				Usage: "record the chia rpc replies into this directory, overrides rpc_record",
+			},
+			cli.StringFlag{
+				Name:  "rpc-replay",
+				Usage: "serve the chia rpc calls from the replies recorded in this directory, overrides rpc_replay",
+			},
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
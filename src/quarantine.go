@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+const DefaultQuarantineAfter = 3
+
+// failure classes of sync
+const ErrorClassTransient = "transient"
+const ErrorClassDatabase = "database"
+const ErrorClassData = "data"
+
+const syncBackoffMin = time.Second
+const syncBackoffMax = 5 * time.Minute
+
+// an error of sync with its failure class, Height is the block which caused a data error
+type SyncError struct {
+	Class  string
+	Height uint64
+	Err    error
+}
+
+func (e *SyncError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SyncError) Unwrap() error {
+	return e.Err
+}
+
+func DataError(height uint64, err error) error {
+	return &SyncError{Class: ErrorClassData, Height: height, Err: err}
+}
+
+// failure class of an rpc error, a response which is not valid json for the result is a data error
+func ClassifyRpcError(err error) string {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) || errors.As(err, &typeError) {
+		return ErrorClassData
+	}
+	return ErrorClassTransient
+}
+
+// failure class of an error of a batch transaction, errors without a class come from the database
+func ClassifyError(err error) string {
+	var syncError *SyncError
+	if errors.As(err, &syncError) {
+		return syncError.Class
+	}
+	return ErrorClassDatabase
+}
+
+// exponential backoff between Min and Max, doubled by every consecutive failure
+type Backoff struct {
+	Min      time.Duration
+	Max      time.Duration
+	Attempts int
+}
+
+func (b *Backoff) Next() time.Duration {
+	delay := b.Min << uint(b.Attempts)
+	if delay > b.Max || delay <= 0 {
+		delay = b.Max
+	}
+	b.Attempts++
+	return delay
+}
+
+func (b *Backoff) Reset() {
+	b.Attempts = 0
+}
+
+// wait for the next delay of the backoff or until ctx is done
+func (b *Backoff) Wait(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(b.Next()):
+	}
+}
+
+// a block sync could not process, it is skipped by the aggregates until it is retried
+type ChiaQuarantinedBlock struct {
+	ID         uint64    `gorm:"primaryKey;<-:false" json:"id"`
+	Height     uint64    `gorm:"type:bigint(20);not null;uniqueIndex:uk_qb_height" json:"height"`
+	HeaderHash string    `gorm:"type:varchar(256);not null;default:''" json:"header_hash"`
+	Class      string    `gorm:"type:varchar(32);not null;default:''" json:"class"`
+	Reason     string    `gorm:"type:varchar(1024);not null;default:''" json:"reason"`
+	Attempts   uint64    `gorm:"type:bigint(20);not null;default:0" json:"attempts"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// record a block which can not be processed and move the blocks cursor past it.
+// headerHash is empty if the block could not be decoded.
+func QuarantineBlock(db *gorm.DB, height uint64, headerHash string, class string, reason error, attempts int) error {
+	message := reason.Error()
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		block := ChiaQuarantinedBlock{Height: height, HeaderHash: headerHash, Class: class, Reason: message, Attempts: uint64(attempts)}
+		r := tx.Clauses(clause.OnConflict{
+			DoUpdates: clause.AssignmentColumns([]string{"header_hash", "class", "reason", "attempts", "updated_at"}),
+		}).Create(&block)
+		if r.Error != nil {
+			return fmt.Errorf("error quarantine block %d: %v", height, r.Error)
+		}
+		err := LogSyncHeight(height, headerHash, tx)
+		if err != nil {
+			return fmt.Errorf("error log sync height: %v", err)
+		}
+		fmt.Printf("quarantined block %d (%s): %s \r\n", height, class, message)
+		return nil
+	})
+}
+
+// heights of [from, to] in quarantine
+func QuarantinedHeights(db *gorm.DB, from uint64, to uint64) ([]uint64, error) {
+	var heights []uint64
+	r := db.Model(&ChiaQuarantinedBlock{}).Where("height >= ? and height <= ?", from, to).Order("height").Pluck("height", &heights)
+	if r.Error != nil {
+		return nil, fmt.Errorf("error read quarantined blocks: %v", r.Error)
+	}
+	return heights, nil
+}
+
+// process a quarantined block again, it is released from the quarantine when it is stored.
+// returns false if it is still failing.
+func RetryQuarantinedBlock(ctx context.Context, node *FullNodeClient, config *Config, db *gorm.DB, quarantined *ChiaQuarantinedBlock) (bool, error) {
+	syncHeight, err := GetSyncedHeight(db)
+	if err != nil {
+		return false, err
+	}
+	if syncHeight == nil || quarantined.Height > syncHeight.Height {
+		return false, fmt.Errorf("block %d was rolled back, sync processes it again", quarantined.Height)
+	}
+	blocks, err := fetchBlockRange(ctx, node, quarantined.Height, quarantined.Height+1)
+	if err != nil {
+		return false, err
+	}
+	if quarantined.HeaderHash != "" && blocks[0].HeaderHash != quarantined.HeaderHash {
+		// the block left the chain, its replacement was synced after the chain reorg
+		r := db.Delete(quarantined)
+		if r.Error != nil {
+			return false, fmt.Errorf("error release block %d: %v", quarantined.Height, r.Error)
+		}
+		fmt.Printf("quarantined block %d is no longer on the chain, released \r\n", quarantined.Height)
+		return true, nil
+	}
+	// the next transaction block is needed to interpolate the timestamp
+	extended := blocks
+	for height := quarantined.Height + 1; extended[len(extended)-1].BlockTimestamp == 0 && height <= syncHeight.Height; height += 10 {
+		end := height + 10
+		if end > syncHeight.Height+1 {
+			end = syncHeight.Height + 1
+		}
+		fetched, err := fetchBlockRange(ctx, node, height, end)
+		if err != nil {
+			return false, err
+		}
+		extended = append(extended, fetched...)
+	}
+	prevTx, err := PrevTransactionBlock(ctx, node, db, &blocks[0], nil)
+	if err != nil {
+		return false, err
+	}
+	prev, err := PrevBlock(ctx, node, db, &blocks[0], nil)
+	if err != nil {
+		return false, err
+	}
+	InterpolateTimestamps(extended, prevTx)
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// the lock keeps a chain reorg from rolling the block back meanwhile
+		var cursor ChiaBlockSyncHeight
+		r := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", CursorBlocks).Take(&cursor)
+		if r.Error != nil {
+			return fmt.Errorf("error lock sync height: %v", r.Error)
+		}
+		r = tx.Where("id = ?", quarantined.ID).Delete(&ChiaQuarantinedBlock{})
+		if r.Error != nil {
+			return fmt.Errorf("error release block %d: %v", quarantined.Height, r.Error)
+		}
+		if r.RowsAffected == 0 || cursor.Height < quarantined.Height {
+			return fmt.Errorf("block %d was rolled back, sync processes it again", quarantined.Height)
+		}
+		// the interpolated block is the one of extended, blocks shares no memory with it once extended grew
+		err := StoreBlockRecords(extended[:1], prev, config, tx)
+		if err != nil {
+			return err
+		}
+		// derived pipelines skipped the block, they process it and the blocks after it again
+		return ResetCursors(quarantined.Height, config, tx)
+	})
+	if err == nil {
+		return true, nil
+	}
+	if ClassifyError(err) != ErrorClassData {
+		return false, err
+	}
+	quarantined.Attempts++
+	quarantined.Reason = err.Error()
+	r := db.Model(quarantined).Updates(map[string]interface{}{"attempts": quarantined.Attempts, "reason": quarantined.Reason})
+	if r.Error != nil {
+		return false, fmt.Errorf("error update quarantined block %d: %v", quarantined.Height, r.Error)
+	}
+	return false, nil
+}
+
+func QuarantineListAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb)
+	if err != nil {
+		return err
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+	var blocks []ChiaQuarantinedBlock
+	r := db.Order("height").Find(&blocks)
+	if r.Error != nil {
+		return fmt.Errorf("error read quarantined blocks: %v", r.Error)
+	}
+	for _, block := range blocks {
+		fmt.Printf("%d %s %s attempts: %d, since %s: %s \r\n", block.Height, block.HeaderHash, block.Class, block.Attempts,
+			block.CreatedAt.Format("2006-01-02 15:04:05"), block.Reason)
+	}
+	return nil
+}
+
+func QuarantineRetryAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb|NeedFullNode)
+	if err != nil {
+		return err
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+	runCtx, stop := SignalContext()
+	defer stop()
+	pool, err := NewFullNodePool(config)
+	if err != nil {
+		return err
+	}
+	node, err := pool.Select(runCtx)
+	if err != nil {
+		return err
+	}
+	query := db.Order("height")
+	if ctx.IsSet("height") {
+		query = query.Where("height = ?", ctx.Uint64("height"))
+	}
+	var blocks []ChiaQuarantinedBlock
+	r := query.Find(&blocks)
+	if r.Error != nil {
+		return fmt.Errorf("error read quarantined blocks: %v", r.Error)
+	}
+	released := 0
+	for index := range blocks {
+		if runCtx.Err() != nil {
+			break
+		}
+		ok, err := RetryQuarantinedBlock(runCtx, node, config, db, &blocks[index])
+		if err != nil {
+			fmt.Printf("error retry block %d: %v \r\n", blocks[index].Height, err)
+		} else if ok {
+			released++
+		} else {
+			fmt.Printf("block %d still fails: %s \r\n", blocks[index].Height, blocks[index].Reason)
+		}
+	}
+	fmt.Printf("released %d of %d quarantined blocks \r\n", released, len(blocks))
+	return nil
+}
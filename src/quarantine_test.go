@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	backoff := &Backoff{Min: time.Second, Max: 10 * time.Second}
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		delay := backoff.Next()
+		if delay != expected {
+			t.Fatalf("attempt %d: delay %s, expected %s", backoff.Attempts, delay, expected)
+		}
+	}
+	// the shift overflows after many failures, the delay stays at the maximum
+	backoff.Attempts = 70
+	if delay := backoff.Next(); delay != backoff.Max {
+		t.Fatalf("delay %s after %d attempts, expected %s", delay, backoff.Attempts, backoff.Max)
+	}
+	backoff.Reset()
+	if delay := backoff.Next(); delay != backoff.Min {
+		t.Fatalf("delay %s after reset, expected %s", delay, backoff.Min)
+	}
+}
+
+func TestClassifyRpcError(t *testing.T) {
+	var blocks GetBlockRecordsResponse
+	syntaxErr := json.Unmarshal([]byte(`{"block_records": [`), &blocks)
+	typeErr := json.Unmarshal([]byte(`{"block_records": "none"}`), &blocks)
+	cases := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"malformed json", syntaxErr, ErrorClassData},
+		{"wrong json type", typeErr, ErrorClassData},
+		{"wrapped json error", fmt.Errorf("error decode block records: %w", typeErr), ErrorClassData},
+		{"service down", errors.New("connection refused"), ErrorClassTransient},
+		{"error reply", errors.New("block not found"), ErrorClassTransient},
+	}
+	for _, c := range cases {
+		class := ClassifyRpcError(c.err)
+		if class != c.expected {
+			t.Errorf("%s: class %s, expected %s", c.name, class, c.expected)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/urfave/cli"
+	"gorm.io/gorm"
+	"math"
+	"strings"
+	"time"
+)
+
+const rebuildBatch = 1000
+
+// the named lock held by the writers of the aggregates while rebuild swaps the tables
+const aggregatesLock = "chia_reporter_aggregates"
+
+// seconds to wait for aggregatesLock
+const aggregatesLockTimeout = 60
+
+// run f with aggregatesLock held on a dedicated connection of db, f runs its statements on that connection.
+// the lock is released after f returns, so the transactions of f are committed before rebuild can swap the tables.
+func WithAggregatesLock(db *gorm.DB, f func(conn *gorm.DB) error) error {
+	sqlDb, err := db.DB()
+	if err != nil {
+		return fmt.Errorf("error get db: %v", err)
+	}
+	ctx := db.Statement.Context
+	conn, err := sqlDb.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error get db connection: %v", err)
+	}
+	defer conn.Close()
+	locked := db.Session(&gorm.Session{Context: ctx})
+	locked.Statement.ConnPool = conn
+
+	// GET_LOCK returns 1 once acquired, 0 after the timeout and NULL on an error
+	var acquired sql.NullInt64
+	err = locked.Raw("SELECT GET_LOCK(?, ?)", aggregatesLock, aggregatesLockTimeout).Row().Scan(&acquired)
+	if err != nil {
+		return fmt.Errorf("error get lock %s: %v", aggregatesLock, err)
+	}
+	if acquired.Int64 != 1 {
+		return fmt.Errorf("lock %s not acquired within %d seconds", aggregatesLock, aggregatesLockTimeout)
+	}
+	defer func() {
+		var released sql.NullInt64
+		err := locked.WithContext(context.Background()).Raw("SELECT RELEASE_LOCK(?)", aggregatesLock).Row().Scan(&released)
+		if err != nil || released.Int64 != 1 {
+			// a connection which may still hold the lock is closed instead of returned to the pool
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+	return f(locked)
+}
+
+// run f in a transaction of a connection holding aggregatesLock
+func AggregatesTransaction(db *gorm.DB, f func(tx *gorm.DB) error) error {
+	return WithAggregatesLock(db, func(conn *gorm.DB) error {
+		return conn.Transaction(f)
+	})
+}
+
+// name of the table a model is stored in
+func TableName(db *gorm.DB, model interface{}) (string, error) {
+	stmt := &gorm.Statement{DB: db}
+	err := stmt.Parse(model)
+	if err != nil {
+		return "", err
+	}
+	return stmt.Schema.Table, nil
+}
+
+// timestamps of the first and the last second of [fromDay, toDay] in location
+func DayRangeToTimestamps(fromDay string, toDay string, location *time.Location) (uint64, uint64, error) {
+	from, err := time.ParseInLocation("2006-01-02", fromDay, location)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid day %s: %v", fromDay, err)
+	}
+	to, err := time.ParseInLocation("2006-01-02", toDay, location)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid day %s: %v", toDay, err)
+	}
+	return uint64(from.Unix()), uint64(to.AddDate(0, 0, 1).Unix()) - 1, nil
+}
+
+// timestamps of the first and the last stored block of [fromHeight, toHeight]
+func HeightRangeToTimestamps(db *gorm.DB, fromHeight uint64, toHeight uint64) (uint64, uint64, error) {
+	var bounds struct {
+		MinTimestamp uint64
+		MaxTimestamp uint64
+	}
+	r := db.Model(&ChiaBlockRecord{}).
+		Select("min(block_timestamp) as min_timestamp, max(block_timestamp) as max_timestamp").
+		Where("height >= ? and height <= ?", fromHeight, toHeight).
+		Take(&bounds)
+	if r.Error != nil {
+		return 0, 0, fmt.Errorf("error read block timestamps: %v", r.Error)
+	}
+	if bounds.MaxTimestamp == 0 {
+		return 0, 0, fmt.Errorf("no stored blocks between height %d and %d", fromHeight, toHeight)
+	}
+	return bounds.MinTimestamp, bounds.MaxTimestamp, nil
+}
+
+// the periods of every granularity and timezone touched by [from, to]
+type rebuildRange struct {
+	Granularity *Granularity
+	Timezone    string
+	From        string
+	To          string
+}
+
+func rebuildRanges(timezones []ReportTimezone, from uint64, to uint64) ([]rebuildRange, uint64, uint64) {
+	var ranges []rebuildRange
+	first, last := from, to
+	for _, granularity := range Granularities {
+		for _, timezone := range timezones {
+			ranges = append(ranges, rebuildRange{
+				Granularity: granularity,
+				Timezone:    timezone.Name,
+				From:        granularity.Period(from, timezone.Location),
+				To:          granularity.Period(to, timezone.Location),
+			})
+			start, end := granularity.Bounds(from, to, timezone.Location)
+			if start < first {
+				first = start
+			}
+			if end > last {
+				last = end
+			}
+		}
+	}
+	return ranges, first, last
+}
+
+// count stored blocks per farmer and period, only blocks with timestamp in [from, to] are counted
+func CountPeriodBlocks(db *gorm.DB, timezones []ReportTimezone, from uint64, to uint64) (*FarmerBlockCounts, error) {
+	counts := NewFarmerBlockCounts(timezones)
+	var blocks []ChiaBlockRecord
+	r := db.Model(&ChiaBlockRecord{}).
+		Select("id, farmer_address, block_timestamp").
+		Where("block_timestamp >= ? and block_timestamp <= ?", from, to).
+		FindInBatches(&blocks, rebuildBatch*10, func(tx *gorm.DB, batch int) error {
+			for _, block := range blocks {
+				counts.AddPeriods(block.FarmerAddress, block.BlockTimestamp)
+			}
+			return nil
+		})
+	if r.Error != nil {
+		return nil, fmt.Errorf("error read blocks: %v", r.Error)
+	}
+	return counts, nil
+}
+
+// the stored block records must hold every height up to the sync height except the quarantined ones,
+// otherwise the rebuilt aggregates would drop the blocks synced before sync_blocks was enabled
+func checkStoredBlocks(db *gorm.DB, syncHeight *ChiaBlockSyncHeight) error {
+	if syncHeight == nil {
+		return fmt.Errorf("no synced blocks, rebuild requires sync_blocks to be enabled")
+	}
+	var stored struct {
+		Lowest *uint64
+		Count  uint64
+	}
+	r := db.Model(&ChiaBlockRecord{}).Select("MIN(height) AS lowest, COUNT(DISTINCT height) AS count").
+		Where("height <= ?", syncHeight.Height).Take(&stored)
+	if r.Error != nil {
+		return fmt.Errorf("error count blocks: %v", r.Error)
+	}
+	if stored.Lowest == nil {
+		return fmt.Errorf("no stored block records, rebuild requires sync_blocks to be enabled")
+	}
+	var quarantined int64
+	r = db.Model(&ChiaQuarantinedBlock{}).Where("height <= ?", syncHeight.Height).Count(&quarantined)
+	if r.Error != nil {
+		return fmt.Errorf("error count quarantined blocks: %v", r.Error)
+	}
+	if stored.Count+uint64(quarantined) != syncHeight.Height+1 {
+		return fmt.Errorf("stored block records start at height %d and hold %d of %d synced heights, "+
+			"run resync --from 0 with sync_blocks enabled before rebuild", *stored.Lowest, stored.Count, syncHeight.Height+1-uint64(quarantined))
+	}
+	return nil
+}
+
+// recompute ChiaTotalFarmerBlocks and the hourly/daily/weekly/monthly aggregates from chia_block_records.
+// with ranged, only the periods touched by [from, to] are recomputed, otherwise every period in every reporting timezone.
+// the results are written into shadow tables which replace the live tables by one atomic rename.
+func RebuildAggregates(db *gorm.DB, config *Config, from uint64, to uint64, ranged bool) error {
+	totalTable, err := TableName(db, &ChiaTotalFarmerBlocks{})
+	if err != nil {
+		return err
+	}
+	blockTable, err := TableName(db, &ChiaBlockRecord{})
+	if err != nil {
+		return err
+	}
+	periodTables := make(map[*Granularity]string)
+	tables := []string{totalTable}
+	for _, granularity := range Granularities {
+		table, err := TableName(db, granularity.Model)
+		if err != nil {
+			return err
+		}
+		periodTables[granularity] = table
+		tables = append(tables, table)
+	}
+	syncHeight, err := GetSyncedHeight(db)
+	if err != nil {
+		return err
+	}
+
+	err = checkStoredBlocks(db, syncHeight)
+	if err != nil {
+		return err
+	}
+
+	// an interrupted rebuild may have left its shadow tables or the old tables behind
+	var r *gorm.DB
+	for _, table := range tables {
+		shadow := table + "_rebuild"
+		r = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS `%s_old`, `%s`", table, shadow))
+		if r.Error == nil {
+			r = db.Exec(fmt.Sprintf("CREATE TABLE `%s` LIKE `%s`", shadow, table))
+		}
+		if r.Error != nil {
+			return fmt.Errorf("error create shadow table %s: %v", shadow, r.Error)
+		}
+	}
+
+	fmt.Printf("rebuilding %s \r\n", totalTable)
+	r = db.Exec(fmt.Sprintf("INSERT INTO `%s_rebuild` (farmer_address, block_count) "+
+		"SELECT farmer_address, COUNT(*) FROM `%s` GROUP BY farmer_address", totalTable, blockTable))
+	if r.Error != nil {
+		return fmt.Errorf("error rebuild total blocks: %v", r.Error)
+	}
+
+	var ranges []rebuildRange
+	if ranged {
+		ranges, from, to = rebuildRanges(config.ReportTimezones, from, to)
+		// keep the rows of the periods outside of the range
+		for _, granularity := range Granularities {
+			var conditions []string
+			var values []interface{}
+			for _, period := range ranges {
+				if period.Granularity == granularity {
+					conditions = append(conditions, fmt.Sprintf("NOT (timezone = ? AND %s >= ? AND %s <= ?)", granularity.Column, granularity.Column))
+					values = append(values, period.Timezone, period.From, period.To)
+				}
+			}
+			table := periodTables[granularity]
+			r = db.Exec(fmt.Sprintf("INSERT INTO `%s_rebuild` (farmer_address, block_count, %s, timezone) "+
+				"SELECT farmer_address, block_count, %s, timezone FROM `%s` WHERE %s",
+				table, granularity.Column, granularity.Column, table, strings.Join(conditions, " AND ")), values...)
+			if r.Error != nil {
+				return fmt.Errorf("error copy %s blocks: %v", granularity.Name, r.Error)
+			}
+		}
+	}
+
+	fmt.Printf("rebuilding hourly/daily/weekly/monthly blocks \r\n")
+	counts, err := CountPeriodBlocks(db, config.ReportTimezones, from, to)
+	if err != nil {
+		return err
+	}
+	// blocks of the widened range only complete the periods at its edges
+	for key := range counts.Periods {
+		for _, period := range ranges {
+			if period.Granularity == key.Granularity && period.Timezone == key.Timezone &&
+				(key.Period < period.From || key.Period > period.To) {
+				delete(counts.Periods, key)
+			}
+		}
+	}
+	for _, granularity := range Granularities {
+		rows := counts.PeriodRows(granularity)
+		if len(rows) == 0 {
+			continue
+		}
+		r = db.Table(periodTables[granularity]+"_rebuild").CreateInBatches(rows, rebuildBatch)
+		if r.Error != nil {
+			return fmt.Errorf("error rebuild %s blocks: %v", granularity.Name, r.Error)
+		}
+	}
+
+	var renames []string
+	for _, table := range tables {
+		renames = append(renames, fmt.Sprintf("`%s` TO `%s_old`, `%s_rebuild` TO `%s`", table, table, table, table))
+	}
+	// sync commits its batches holding the aggregates lock, so no batch is committed into the old tables
+	// between the check of the sync height and the rename
+	err = WithAggregatesLock(db, func(conn *gorm.DB) error {
+		var current ChiaBlockSyncHeight
+		r := conn.Where("name = ?", CursorBlocks).Limit(1).Find(&current)
+		if r.Error != nil {
+			return fmt.Errorf("error read sync height: %v", r.Error)
+		}
+		if r.RowsAffected == 0 || syncHeight == nil || current.Height != syncHeight.Height ||
+			current.HeaderHash != syncHeight.HeaderHash {
+			return fmt.Errorf("blocks were synced during the rebuild, stop sync and run rebuild again")
+		}
+		err := checkStoredBlocks(conn, &current)
+		if err != nil {
+			return err
+		}
+		r = conn.Exec("RENAME TABLE " + strings.Join(renames, ", "))
+		if r.Error != nil {
+			return fmt.Errorf("error swap rebuilt tables: %v", r.Error)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		r = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS `%s_old`", table))
+		if r.Error != nil {
+			return fmt.Errorf("error drop old table: %v", r.Error)
+		}
+	}
+	return nil
+}
+
+func RebuildAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb)
+	if err != nil {
+		return err
+	}
+	if config.WatchlistMode {
+		return fmt.Errorf("watchlist_mode only stores the watched blocks, rebuild requires sync_blocks")
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+
+	from, to := uint64(0), uint64(math.MaxInt64)
+	ranged := false
+	fromDay, toDay := ctx.String("from-day"), ctx.String("to-day")
+	if ctx.IsSet("from-height") || ctx.IsSet("to-height") {
+		if fromDay != "" || toDay != "" {
+			return fmt.Errorf("height range and day range can not be used together")
+		}
+		toHeight := ctx.Uint64("to-height")
+		if !ctx.IsSet("to-height") {
+			syncHeight, err := GetSyncedHeight(db)
+			if err != nil {
+				return err
+			}
+			if syncHeight != nil {
+				toHeight = syncHeight.Height
+			}
+		}
+		from, to, err = HeightRangeToTimestamps(db, ctx.Uint64("from-height"), toHeight)
+		if err != nil {
+			return err
+		}
+		ranged = true
+	} else if fromDay != "" || toDay != "" {
+		if fromDay == "" || toDay == "" {
+			return fmt.Errorf("both from-day and to-day are required")
+		}
+		// days are taken in the first reporting timezone
+		from, to, err = DayRangeToTimestamps(fromDay, toDay, config.ReportTimezones[0].Location)
+		if err != nil {
+			return err
+		}
+		ranged = true
+	}
+
+	began := time.Now()
+	err = RebuildAggregates(db, config, from, to, ranged)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rebuild done in %s \r\n", time.Since(began))
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+const DefaultMaxReorgDepth = 100
+
+// the blocks below a reorg are not stored, so its fork point can not be found
+var errForkBlocksMissing = errors.New("blocks are not stored")
+
+type ChiaReorgLog struct {
+	ID          uint64    `gorm:"primaryKey;<-:false" json:"id"`
+	ForkHeight  uint64    `gorm:"type:bigint(20);not null;default:0" json:"fork_height"`
+	ForkHash    string    `gorm:"type:varchar(256);not null;default:''" json:"fork_hash"`
+	FromHeight  uint64    `gorm:"type:bigint(20);not null;default:0" json:"from_height"`
+	ToHeight    uint64    `gorm:"type:bigint(20);not null;default:0" json:"to_height"`
+	Depth       uint64    `gorm:"type:bigint(20);not null;default:0" json:"depth"`
+	OldPeakHash string    `gorm:"type:varchar(256);not null;default:''" json:"old_peak_hash"`
+	RolledBack  bool      `gorm:"type:bool;not null;default:false" json:"rolled_back"`
+	CreatedAt   time.Time `gorm:"index:idx_rl_created_at" json:"created_at"`
+}
+
+// the last max_reorg_depth synced blocks, kept without sync_blocks to find the fork point of a chain reorg
+// and undo the contribution of the orphaned blocks to the aggregates
+type ChiaRecentBlock struct {
+	ID                 uint64 `gorm:"primaryKey;<-:false" json:"id"`
+	Height             uint64 `gorm:"type:bigint(20);not null;default:0;uniqueIndex:uk_rb_height" json:"height"`
+	HeaderHash         string `gorm:"type:varchar(256);not null;default:''" json:"header_hash"`
+	FarmerAddress      string `gorm:"type:varchar(256);not null;default:''" json:"farmer_address"`
+	BlockTimestamp     uint64 `gorm:"type:bigint(20);not null;default:0" json:"block_timestamp"`
+	IsTransactionBlock bool   `gorm:"type:bool;not null;default:false" json:"is_transaction_block"`
+	Fees               uint64 `gorm:"type:bigint(20);not null;default:0" json:"fees"`
+}
+
+// the blocks a reorg is rolled back from: every block with sync_blocks, the recent ones otherwise
+func reorgBlocksModel(config *Config) interface{} {
+	if config.SyncBlocks {
+		return &ChiaBlockRecord{}
+	}
+	return &ChiaRecentBlock{}
+}
+
+// the columns of the recent blocks, read into ChiaBlockRecord from either table
+var reorgBlockColumns = []string{"id", "height", "header_hash", "farmer_address", "block_timestamp", "is_transaction_block", "fees"}
+
+// keep a batch of blocks with interpolated timestamps as the recent blocks and forget the blocks below max_reorg_depth
+func StoreRecentBlocks(blocks []ChiaBlockRecord, config *Config, tx *gorm.DB) error {
+	recent := make([]ChiaRecentBlock, len(blocks))
+	for index, block := range blocks {
+		recent[index] = ChiaRecentBlock{
+			Height:             block.Height,
+			HeaderHash:         block.HeaderHash,
+			FarmerAddress:      block.FarmerAddress,
+			BlockTimestamp:     block.BlockTimestamp,
+			IsTransactionBlock: block.IsTransactionBlock,
+			Fees:               block.Fees,
+		}
+	}
+	r := tx.Clauses(clause.OnConflict{
+		DoUpdates: clause.AssignmentColumns([]string{"header_hash", "farmer_address", "block_timestamp", "is_transaction_block", "fees"}),
+	}).Create(&recent)
+	if r.Error != nil {
+		return fmt.Errorf("error save recent blocks: %v", r.Error)
+	}
+	last := blocks[len(blocks)-1].Height
+	if last > config.MaxReorgDepth {
+		r = tx.Where("height < ?", last-config.MaxReorgDepth).Delete(&ChiaRecentBlock{})
+		if r.Error != nil {
+			return fmt.Errorf("error delete old recent blocks: %v", r.Error)
+		}
+	}
+	return nil
+}
+
+// check the blocks extend the chain ending with prevHash and are linked to each other.
+// an empty prevHash means the hash of the previous block is unknown.
+func BlocksLinked(prevHash string, blocks []ChiaBlockRecord) bool {
+	for _, block := range blocks {
+		if prevHash != "" && block.PrevHash != prevHash {
+			return false
+		}
+		prevHash = block.HeaderHash
+	}
+	return true
+}
+
+// walk back from height until the stored header hash equals the full node's header hash.
+// returns the last common block.
+func FindForkPoint(ctx context.Context, node *FullNodeClient, config *Config, db *gorm.DB, height uint64) (*ChiaBlockRecord, error) {
+	maxDepth := config.MaxReorgDepth
+	lowest := uint64(0)
+	if height > maxDepth {
+		lowest = height - maxDepth
+	}
+	batch := uint64(10)
+	for end := height + 1; end > lowest; {
+		start := lowest
+		if end-lowest > batch {
+			start = end - batch
+		}
+		result, err := node.GetBlockRecords(ctx, GetBlockRecordsRequest{Start: start, End: end})
+		if err != nil {
+			return nil, err
+		}
+		var stored []ChiaBlockRecord
+		r := db.Model(reorgBlocksModel(config)).Select(reorgBlockColumns).Where("height >= ? and height < ?", start, end).Order("height desc").Find(&stored)
+		if r.Error != nil {
+			return nil, fmt.Errorf("error read stored blocks: %v", r.Error)
+		}
+		canonical := make(map[uint64]string, len(result.BlockRecords))
+		for _, block := range result.BlockRecords {
+			canonical[block.Height] = block.HeaderHash
+		}
+		for index, block := range stored {
+			if index == 0 && block.Height != end-1 {
+				return nil, fmt.Errorf("block of height %d: %w", end-1, errForkBlocksMissing)
+			}
+			if canonical[block.Height] == block.HeaderHash {
+				return &stored[index], nil
+			}
+		}
+		if uint64(len(stored)) < end-start {
+			return nil, fmt.Errorf("blocks between %d and %d: %w", start, end-1, errForkBlocksMissing)
+		}
+		end = start
+	}
+	return nil, fmt.Errorf("fork point not found within %d blocks below height %d", maxDepth, height)
+}
+
+// delete blocks above the fork point and undo their contribution to farmer aggregates and epoch statistics.
+// in watchlist mode the orphaned watched blocks are removed as well.
+func RollbackBlocks(fork *ChiaBlockRecord, config *Config, db *gorm.DB) (*ChiaReorgLog, error) {
+	syncHeight, err := GetSyncedHeight(db)
+	if err != nil {
+		return nil, err
+	}
+	if syncHeight == nil || syncHeight.Height <= fork.Height {
+		return nil, fmt.Errorf("nothing to rollback above height %d", fork.Height)
+	}
+
+	var blocks []ChiaBlockRecord
+	r := db.Model(reorgBlocksModel(config)).Select(reorgBlockColumns).Where("height > ?", fork.Height).Order("height").Find(&blocks)
+	if r.Error != nil {
+		return nil, fmt.Errorf("error read blocks to rollback: %v", r.Error)
+	}
+	counts := NewFarmerBlockCounts(config.ReportTimezones)
+	for _, block := range blocks {
+		counts.Add(block.FarmerAddress, block.BlockTimestamp)
+	}
+	err = SubtractFarmerBlocks(counts, db)
+	if err != nil {
+		return nil, err
+	}
+	r = db.Where("height > ?", fork.Height).Delete(reorgBlocksModel(config))
+	if r.Error != nil {
+		return nil, fmt.Errorf("error delete rolled back blocks: %v", r.Error)
+	}
+	if config.WatchlistMode {
+		err = OrphanWatchedBlocks(fork, db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// sync processes the quarantined blocks of the new chain again
+	r = db.Where("height > ?", fork.Height).Delete(&ChiaQuarantinedBlock{})
+	if r.Error != nil {
+		return nil, fmt.Errorf("error delete rolled back quarantined blocks: %v", r.Error)
+	}
+	if config.SyncBlocks {
+		err = RecomputeEpochStats(db, (fork.Height+1)/EpochBlocks, syncHeight.Height/EpochBlocks)
+	} else {
+		err = SubtractEpochStats(fork, blocks, db)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = RewindCursors(fork, config, db)
+	if err != nil {
+		return nil, err
+	}
+	err = LogSyncHeight(fork.Height, fork.HeaderHash, db)
+	if err != nil {
+		return nil, fmt.Errorf("error log sync height: %v", err)
+	}
+
+	reorg := &ChiaReorgLog{
+		ForkHeight:  fork.Height,
+		ForkHash:    fork.HeaderHash,
+		FromHeight:  fork.Height + 1,
+		ToHeight:    syncHeight.Height,
+		Depth:       syncHeight.Height - fork.Height,
+		OldPeakHash: syncHeight.HeaderHash,
+		RolledBack:  true,
+	}
+	r = db.Create(reorg)
+	if r.Error != nil {
+		return nil, fmt.Errorf("error log reorg: %v", r.Error)
+	}
+	return reorg, nil
+}
+
+// handle a chain reorganization detected at height, returns the height and header hash to resume sync from.
+// the fork point is searched in the stored block records with sync_blocks and in the recent blocks otherwise,
+// the blocks above it are rolled back and sync continues from the fork point on the new chain.
+func HandleReorg(ctx context.Context, node *FullNodeClient, config *Config, db *gorm.DB, height uint64) (uint64, string, error) {
+	fork, err := FindForkPoint(ctx, node, config, db, height)
+	if errors.Is(err, errForkBlocksMissing) && !config.SyncBlocks {
+		// the recent blocks are kept since this version, a reorg right after the upgrade can not be rolled back
+		return logReorg(config, db, height, err)
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("error find fork point: %v", err)
+	}
+	var reorg *ChiaReorgLog
+	err = AggregatesTransaction(db, func(tx *gorm.DB) error {
+		reorg, err = RollbackBlocks(fork, config, tx)
+		return err
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	fmt.Printf("chain reorg rolled back, fork height: %d, depth: %d \r\n", reorg.ForkHeight, reorg.Depth)
+	return fork.Height + 1, fork.HeaderHash, nil
+}
+
+// log a reorg whose fork point is not among the recent blocks, sync continues on the new chain after height
+func logReorg(config *Config, db *gorm.DB, height uint64, reason error) (uint64, string, error) {
+	syncHeight, err := GetSyncedHeight(db)
+	if err != nil {
+		return 0, "", err
+	}
+	reorg := ChiaReorgLog{
+		FromHeight: height,
+		ToHeight:   height,
+	}
+	if syncHeight != nil {
+		reorg.OldPeakHash = syncHeight.HeaderHash
+	}
+	r := db.Create(&reorg)
+	if r.Error != nil {
+		return 0, "", fmt.Errorf("error log reorg: %v", r.Error)
+	}
+	fmt.Printf("chain reorg detected at height %d can not be rolled back: %v \r\n", height, reason)
+	return height + 1, "", nil
+}
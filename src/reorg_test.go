@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestBlocksLinked(t *testing.T) {
+	block := func(prevHash string, headerHash string) ChiaBlockRecord {
+		return ChiaBlockRecord{PrevHash: prevHash, HeaderHash: headerHash}
+	}
+	cases := []struct {
+		name     string
+		prevHash string
+		blocks   []ChiaBlockRecord
+		expected bool
+	}{
+		{"linked", "0xa", []ChiaBlockRecord{block("0xa", "0xb"), block("0xb", "0xc")}, true},
+		{"unknown previous hash", "", []ChiaBlockRecord{block("0xa", "0xb"), block("0xb", "0xc")}, true},
+		{"does not extend the chain", "0xa", []ChiaBlockRecord{block("0xf", "0xb"), block("0xb", "0xc")}, false},
+		{"gap within the batch", "0xa", []ChiaBlockRecord{block("0xa", "0xb"), block("0xf", "0xc")}, false},
+		{"gap without a previous hash", "", []ChiaBlockRecord{block("0xa", "0xb"), block("0xf", "0xc")}, false},
+		{"empty", "0xa", nil, true},
+	}
+	for _, c := range cases {
+		linked := BlocksLinked(c.prevHash, c.blocks)
+		if linked != c.expected {
+			t.Errorf("%s: linked %v, expected %v", c.name, linked, c.expected)
+		}
+	}
+}
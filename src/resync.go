@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/urfave/cli"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const resyncBatch = 100
+
+// heights resynced per transaction
+const resyncRangeBatch = 1000
+
+// fetch the blocks of [start, end) and check the full node returned all of them
+func fetchBlockRange(ctx context.Context, node *FullNodeClient, start uint64, end uint64) ([]ChiaBlockRecord, error) {
+	result, err := node.GetBlockRecords(ctx, GetBlockRecordsRequest{Start: start, End: end})
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(result.BlockRecords)) != end-start {
+		return nil, fmt.Errorf("expect %d blocks from height %d, got %d", end-start, start, len(result.BlockRecords))
+	}
+	return result.BlockRecords, nil
+}
+
+// fetch the synced blocks of [from, to] with their timestamps interpolated,
+// they must link to the stored blocks around the range, a missing block after the range is a gap and not checked.
+// returns the stored block before the range, empty if from is 0.
+func fetchSyncedRange(ctx context.Context, node *FullNodeClient, db *gorm.DB, from uint64, to uint64, syncHeight *ChiaBlockSyncHeight) ([]ChiaBlockRecord, *ChiaBlockRecord, error) {
+	var blocks []ChiaBlockRecord
+	for start := from; start <= to; start += resyncBatch {
+		end := start + resyncBatch
+		if end > to+1 {
+			end = to + 1
+		}
+		fetched, err := fetchBlockRange(ctx, node, start, end)
+		if err != nil {
+			return nil, nil, err
+		}
+		blocks = append(blocks, fetched...)
+	}
+	// blocks after the last transaction block need the next one to interpolate their timestamps.
+	// extended is a copy, so the blocks of the range are taken back from it once interpolated
+	extended := append([]ChiaBlockRecord(nil), blocks...)
+	for height := to + 1; height <= syncHeight.Height; height += 10 {
+		if extended[len(extended)-1].BlockTimestamp != 0 {
+			break
+		}
+		end := height + 10
+		if end > syncHeight.Height+1 {
+			end = syncHeight.Height + 1
+		}
+		fetched, err := fetchBlockRange(ctx, node, height, end)
+		if err != nil {
+			return nil, nil, err
+		}
+		extended = append(extended, fetched...)
+	}
+
+	var before, after ChiaBlockRecord
+	if from > 0 {
+		r := db.Where("height = ?", from-1).Limit(1).Find(&before)
+		if r.Error != nil {
+			return nil, nil, fmt.Errorf("error read block %d: %v", from-1, r.Error)
+		}
+		if r.RowsAffected == 0 {
+			return nil, nil, fmt.Errorf("stored block of height %d not found", from-1)
+		}
+	}
+	if !BlocksLinked(before.HeaderHash, extended) {
+		return nil, nil, fmt.Errorf("fetched blocks do not extend stored block %d, the chain changed, run sync first", from-1)
+	}
+	if to < syncHeight.Height {
+		r := db.Where("height = ?", to+1).Limit(1).Find(&after)
+		if r.Error != nil {
+			return nil, nil, fmt.Errorf("error read block %d: %v", to+1, r.Error)
+		}
+		if r.RowsAffected > 0 && after.PrevHash != blocks[len(blocks)-1].HeaderHash {
+			return nil, nil, fmt.Errorf("stored block %d does not extend the fetched blocks, the chain changed, run sync first", to+1)
+		}
+	}
+
+	prevTx, err := PrevTransactionBlock(ctx, node, db, &blocks[0], nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	InterpolateTimestamps(extended, prevTx)
+	blocks = extended[:len(blocks)]
+	return blocks, &before, nil
+}
+
+// fetch the blocks of [from, to] again and replace the stored records, one transaction per resyncRangeBatch heights.
+// the range must be synced already and the fetched blocks must link to the stored blocks around it.
+// returns the number of resynced blocks, including the batches committed before an error.
+func ResyncRange(ctx context.Context, node *FullNodeClient, config *Config, db *gorm.DB, from uint64, to uint64) (int, error) {
+	resynced := 0
+	for start := from; start <= to; start += resyncRangeBatch {
+		end := start + resyncRangeBatch - 1
+		if end > to {
+			end = to
+		}
+		count, err := resyncHeights(ctx, node, config, db, start, end)
+		resynced += count
+		if err != nil {
+			return resynced, err
+		}
+	}
+	return resynced, nil
+}
+
+// replace the stored records of [from, to] in one transaction, the contribution of the old records is subtracted
+// from the aggregates before the new one is added. heights without a stored record were counted when they were synced,
+// so only their record is stored, except the quarantined ones which are counted and released.
+func resyncHeights(ctx context.Context, node *FullNodeClient, config *Config, db *gorm.DB, from uint64, to uint64) (int, error) {
+	syncHeight, err := GetSyncedHeight(db)
+	if err != nil {
+		return 0, err
+	}
+	if syncHeight == nil || to > syncHeight.Height {
+		return 0, fmt.Errorf("height %d is not synced yet, use sync or backfill", to)
+	}
+	blocks, before, err := fetchSyncedRange(ctx, node, db, from, to, syncHeight)
+	if err != nil {
+		return 0, err
+	}
+	_, _, err = CountBlockRecords(blocks, before, config)
+	if err != nil {
+		return 0, err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// the lock keeps sync from committing blocks meanwhile
+		var cursor ChiaBlockSyncHeight
+		r := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", CursorBlocks).Take(&cursor)
+		if r.Error != nil {
+			return fmt.Errorf("error lock sync height: %v", r.Error)
+		}
+		if cursor.Height != syncHeight.Height || cursor.HeaderHash != syncHeight.HeaderHash {
+			return fmt.Errorf("blocks were synced during the resync, run resync again")
+		}
+		var stored []ChiaBlockRecord
+		r = tx.Where("height >= ? and height <= ?", from, to).Find(&stored)
+		if r.Error != nil {
+			return fmt.Errorf("error read stored blocks: %v", r.Error)
+		}
+		old := NewFarmerBlockCounts(config.ReportTimezones)
+		storedHeights := make(map[uint64]bool, len(stored))
+		for _, block := range stored {
+			old.Add(block.FarmerAddress, block.BlockTimestamp)
+			storedHeights[block.Height] = true
+		}
+		// quarantined blocks were skipped by the aggregates, they are counted and released
+		quarantined, err := QuarantinedHeights(tx, from, to)
+		if err != nil {
+			return err
+		}
+		for _, height := range quarantined {
+			storedHeights[height] = true
+		}
+		r = tx.Where("height >= ? and height <= ?", from, to).Delete(&ChiaQuarantinedBlock{})
+		if r.Error != nil {
+			return fmt.Errorf("error release quarantined blocks: %v", r.Error)
+		}
+		counts := NewFarmerBlockCounts(config.ReportTimezones)
+		for _, block := range blocks {
+			if storedHeights[block.Height] {
+				counts.Add(block.FarmerAddress, block.BlockTimestamp)
+			}
+		}
+		err = SubtractFarmerBlocks(old, tx)
+		if err != nil {
+			return err
+		}
+		r = tx.Where("height >= ? and height <= ?", from, to).Delete(&ChiaBlockRecord{})
+		if r.Error != nil {
+			return fmt.Errorf("error delete stored blocks: %v", r.Error)
+		}
+		err = UpsertFarmerBlocks(counts, tx)
+		if err != nil {
+			return err
+		}
+		r = tx.CreateInBatches(&blocks, resyncBatch)
+		if r.Error != nil {
+			return fmt.Errorf("error save block records: %v", r.Error)
+		}
+		err = RecomputeEpochStats(tx, from/EpochBlocks, to/EpochBlocks)
+		if err != nil {
+			return err
+		}
+		if to == syncHeight.Height {
+			err = LogSyncHeight(to, blocks[len(blocks)-1].HeaderHash, tx)
+			if err != nil {
+				return fmt.Errorf("error log sync height: %v", err)
+			}
+		}
+		// derived pipelines process the range again, from genesis their cursors are deleted
+		if from > 0 {
+			return RewindCursors(before, config, tx)
+		}
+		return ResetCursors(0, config, tx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(blocks), nil
+}
+
+func ResyncAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb|NeedFullNode)
+	if err != nil {
+		return err
+	}
+	if !config.SyncBlocks {
+		return fmt.Errorf("resync subtracts the stored block records of the range, it requires sync_blocks")
+	}
+	if !ctx.IsSet("from") || !ctx.IsSet("to") {
+		return fmt.Errorf("both from and to are required")
+	}
+	from, to := ctx.Uint64("from"), ctx.Uint64("to")
+	if from > to {
+		return fmt.Errorf("from %d is above to %d", from, to)
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+	runCtx, stop := SignalContext()
+	defer stop()
+	pool, err := NewFullNodePool(config)
+	if err != nil {
+		return err
+	}
+	node, err := pool.Select(runCtx)
+	if err != nil {
+		return err
+	}
+
+	resynced, err := ResyncRange(runCtx, node, config, db, from, to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("resynced %d blocks between height %d and %d from %s \r\n", resynced, from, to, node.Name())
+	return nil
+}
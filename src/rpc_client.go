@@ -1,32 +1,126 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
-func RpcClient(certFile string, keyFile string, caFile string) (*http.Client, error) {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+// bytes of the body of a failed reply kept in the error
+const rpcErrorBodyLimit = 512
+
+// how often the files of a tls identity are checked for changes
+const tlsReloadInterval = 10 * time.Second
+
+// the cert, key and ca of a chia service. the files are checked for changes at most every tlsReloadInterval
+// when a connection is made and loaded again, so rotated certs are used without a restart.
+// files which fail to load, e.g. a cert written before its key, keep the previous identity until the next check.
+type TLSIdentity struct {
+	CertFile string
+	KeyFile  string
+	CaFile   string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	roots    *x509.CertPool
+	modTimes [3]time.Time
+	checked  time.Time
+	onReload []func()
+}
+
+func NewTLSIdentity(certFile string, keyFile string, caFile string) (*TLSIdentity, error) {
+	identity := &TLSIdentity{CertFile: certFile, KeyFile: keyFile, CaFile: caFile}
+	modTimes, err := identity.modTimesOnDisk()
+	if err != nil {
+		return nil, err
+	}
+	err = identity.load(modTimes)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load client certs")
+		return nil, err
 	}
+	return identity, nil
+}
 
-	caCert, err := ioutil.ReadFile(caFile)
+func (i *TLSIdentity) modTimesOnDisk() ([3]time.Time, error) {
+	var modTimes [3]time.Time
+	for index, file := range []string{i.CertFile, i.KeyFile, i.CaFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTimes, fmt.Errorf("failed to stat %s: %v", file, err)
+		}
+		modTimes[index] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (i *TLSIdentity) load(modTimes [3]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(i.CertFile, i.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load client certs %s: %v", i.CertFile, err)
+	}
+	caCert, err := ioutil.ReadFile(i.CaFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load ca file")
+		return fmt.Errorf("failed to load ca file %s: %v", i.CaFile, err)
 	}
 	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return fmt.Errorf("failed to load ca file %s: no certificate found", i.CaFile)
+	}
+	i.cert = &cert
+	i.roots = caCertPool
+	i.modTimes = modTimes
+	return nil
+}
+
+// the current cert and ca, loaded again if the files changed
+func (i *TLSIdentity) current() (*tls.Certificate, *x509.CertPool) {
+	i.mu.Lock()
+	reloaded := false
+	if time.Since(i.checked) >= tlsReloadInterval {
+		i.checked = time.Now()
+		modTimes, err := i.modTimesOnDisk()
+		if err == nil && modTimes != i.modTimes {
+			err = i.load(modTimes)
+			reloaded = err == nil
+		}
+		if err != nil {
+			fmt.Printf("error reload tls identity, keep the loaded one: %v \r\n", err)
+		} else if reloaded {
+			fmt.Printf("reloaded tls identity %s \r\n", i.CertFile)
+		}
+	}
+	cert, roots, onReload := i.cert, i.roots, i.onReload
+	i.mu.Unlock()
+	if reloaded {
+		for _, callback := range onReload {
+			callback()
+		}
+	}
+	return cert, roots
+}
 
-	tlsConfig := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		RootCAs:            caCertPool,
+// call callback after the identity was reloaded, e.g. to close connections made with the old cert
+func (i *TLSIdentity) OnReload(callback func()) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.onReload = append(i.onReload, callback)
+}
+
+// mutual TLS config of the chia services, the server cert is verified against the private ca without the hostname
+func (identity *TLSIdentity) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := identity.current()
+			return cert, nil
+		},
 		InsecureSkipVerify: true, // Not actually skipping, we check the cert in VerifyPeerCertificate
 		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 			// Code copy/pasted and adapted from
@@ -44,8 +138,9 @@ func RpcClient(certFile string, keyFile string, caFile string) (*http.Client, er
 				certs[i] = cert
 			}
 
+			_, roots := identity.current()
 			opts := x509.VerifyOptions{
-				Roots:         caCertPool,
+				Roots:         roots,
 				CurrentTime:   time.Now(),
 				DNSName:       "", // <- skip hostname verification
 				Intermediates: x509.NewCertPool(),
@@ -61,29 +156,50 @@ func RpcClient(certFile string, keyFile string, caFile string) (*http.Client, er
 			return err
 		},
 	}
-	tlsConfig.BuildNameToCertificate()
+}
+
+// rpc client of a tls identity, connections made with a replaced cert are closed once they are idle
+func RpcClient(certFile string, keyFile string, caFile string) (*http.Client, error) {
+	identity, err := NewTLSIdentity(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
 	tr := &http.Transport{
-		TLSClientConfig: tlsConfig,
+		TLSClientConfig: identity.TLSConfig(),
 	}
+	identity.OnReload(tr.CloseIdleConnections)
 
-	client := &http.Client{Transport: tr, Timeout: time.Second * 5}
+	// calls are timed out by the rpc policy of their endpoint
+	client := &http.Client{Transport: tr}
 	return client, nil
 }
 
-func RpcFetch(client *http.Client, url string, data string, result interface{}) error {
+// post data to a chia rpc endpoint and decode the response into result, the request is aborted when ctx is done.
+// a reply with a http status other than 200 is a *RpcStatusError, a reply with success false a *ChiaRpcError.
+func RpcFetch(ctx context.Context, client *http.Client, url string, data string, result rpcEnvelope) error {
 	contentType := "application/json"
 
-	resp, err := client.Post(url, contentType, strings.NewReader(data))
-	if err == nil {
-		defer resp.Body.Close()
-
-		err = json.NewDecoder(resp.Body).Decode(result)
-		if err != nil {
-			return fmt.Errorf("error parsing response: %v", err)
-		}
-	} else {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(data))
+	if err != nil {
 		return fmt.Errorf("error on rpc fetch, url: %s, err: %v", url, err)
 	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return &RpcConnError{Url: url, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, rpcErrorBodyLimit))
+		return &RpcStatusError{Url: url, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return fmt.Errorf("error parsing response: %w", err)
+	}
+	if response := result.rpcResponse(); !response.Success {
+		return &ChiaRpcError{Url: url, Message: response.Error}
+	}
 	return nil
 }
-
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// a reply of a recorded call, a body which is not json is kept as text
+type RpcFixtureResponse struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Text   string          `json:"text,omitempty"`
+}
+
+// the replies of one request to one endpoint of a service in the order they were recorded
+type RpcFixture struct {
+	Url       string               `json:"url"`
+	Request   json.RawMessage      `json:"request"`
+	Responses []RpcFixtureResponse `json:"responses"`
+	replayed  int
+}
+
+// fixtures of the rpc calls in a directory, one file per service, endpoint and request:
+// <dir>/<host>_<port>/<endpoint>/<hash of the request>.json
+type RpcFixtures struct {
+	Dir      string
+	mu       sync.Mutex
+	fixtures map[string]*RpcFixture
+}
+
+// the fixtures of a directory are shared by the rpc clients of a process, so recorded files are written by one
+var rpcFixtures = struct {
+	mu   sync.Mutex
+	dirs map[string]*RpcFixtures
+}{dirs: make(map[string]*RpcFixtures)}
+
+func OpenRpcFixtures(dir string) *RpcFixtures {
+	rpcFixtures.mu.Lock()
+	defer rpcFixtures.mu.Unlock()
+	fixtures, ok := rpcFixtures.dirs[dir]
+	if !ok {
+		fixtures = &RpcFixtures{Dir: dir, fixtures: make(map[string]*RpcFixture)}
+		rpcFixtures.dirs[dir] = fixtures
+	}
+	return fixtures
+}
+
+func (f *RpcFixtures) path(req *http.Request, body []byte) string {
+	hash := sha256.Sum256(body)
+	service := strings.Replace(req.URL.Host, ":", "_", 1)
+	endpoint := strings.Trim(req.URL.Path, "/")
+	return filepath.Join(f.Dir, service, endpoint, hex.EncodeToString(hash[:8])+".json")
+}
+
+// the fixture of a file, nil if it was not recorded
+func (f *RpcFixtures) load(path string) (*RpcFixture, error) {
+	fixture, ok := f.fixtures[path]
+	if ok {
+		return fixture, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error read rpc fixture: %v", err)
+	}
+	fixture = &RpcFixture{}
+	err = json.Unmarshal(data, fixture)
+	if err != nil {
+		return nil, fmt.Errorf("error parse rpc fixture %s: %v", path, err)
+	}
+	f.fixtures[path] = fixture
+	return fixture, nil
+}
+
+// append a reply to the fixture of the request, a reply equal to the last one is not repeated
+func (f *RpcFixtures) Record(req *http.Request, body []byte, status int, reply []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := f.path(req, body)
+	fixture, err := f.load(path)
+	if err != nil {
+		return err
+	}
+	if fixture == nil {
+		fixture = &RpcFixture{Url: req.URL.String(), Request: json.RawMessage(body)}
+		if !json.Valid(body) {
+			fixture.Request = nil
+		}
+		f.fixtures[path] = fixture
+	}
+	response := RpcFixtureResponse{Status: status}
+	if json.Valid(reply) {
+		response.Body = json.RawMessage(reply)
+	} else {
+		response.Text = string(reply)
+	}
+	count := len(fixture.Responses)
+	if count > 0 {
+		last := fixture.Responses[count-1]
+		if last.Status == response.Status && bytes.Equal(last.Body, response.Body) && last.Text == response.Text {
+			return nil
+		}
+	}
+	fixture.Responses = append(fixture.Responses, response)
+
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encode rpc fixture: %v", err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("error create rpc fixture dir: %v", err)
+	}
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		return fmt.Errorf("error write rpc fixture: %v", err)
+	}
+	return nil
+}
+
+// the next recorded reply of the request, the last one is repeated once all were replayed
+func (f *RpcFixtures) Replay(req *http.Request, body []byte) (*RpcFixtureResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := f.path(req, body)
+	fixture, err := f.load(path)
+	if err != nil {
+		return nil, err
+	}
+	if fixture == nil || len(fixture.Responses) == 0 {
+		return nil, fmt.Errorf("no rpc fixture of %s %s, expect %s", req.URL, body, path)
+	}
+	index := fixture.replayed
+	if index < len(fixture.Responses)-1 {
+		fixture.replayed++
+	}
+	return &fixture.Responses[index], nil
+}
+
+// read the body of a request and put it back for the next transport
+func readRequestBody(req *http.Request) (*http.Request, []byte, error) {
+	if req.Body == nil {
+		return req, nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error read request body: %v", err)
+	}
+	clone := req.Clone(req.Context())
+	clone.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return clone, body, nil
+}
+
+// sends the calls with Next and records the replies, failed connections are not recorded
+type RecordTransport struct {
+	Next     http.RoundTripper
+	Fixtures *RpcFixtures
+}
+
+func (t *RecordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error read response body: %v", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(reply))
+	err = t.Fixtures.Record(req, body, resp.StatusCode, reply)
+	if err != nil {
+		fmt.Printf("%v \r\n", err)
+	}
+	return resp, nil
+}
+
+// serves the recorded replies without a chia service, a call which was not recorded fails like an unreachable service
+type ReplayTransport struct {
+	Fixtures *RpcFixtures
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Err() != nil {
+		return nil, req.Context().Err()
+	}
+	req, body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	response, err := t.Fixtures.Replay(req, body)
+	if err != nil {
+		return nil, err
+	}
+	reply := []byte(response.Body)
+	contentType := "application/json"
+	if response.Body == nil {
+		reply = []byte(response.Text)
+		contentType = "text/plain"
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", response.Status, http.StatusText(response.Status)),
+		StatusCode:    response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{contentType}},
+		Body:          ioutil.NopCloser(bytes.NewReader(reply)),
+		ContentLength: int64(len(reply)),
+		Request:       req,
+	}, nil
+}
+
+// the rpc client of a tls identity. with rpc_replay the calls are served from the fixtures and no cert is loaded,
+// with rpc_record the replies of the services are written to the fixtures.
+func (c *Config) RpcClient(certFile string, keyFile string, caFile string) (*http.Client, error) {
+	if c.RpcReplay != "" {
+		return &http.Client{Transport: &ReplayTransport{Fixtures: OpenRpcFixtures(c.RpcReplay)}}, nil
+	}
+	client, err := RpcClient(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	if c.RpcRecord != "" {
+		client.Transport = &RecordTransport{Next: client.Transport, Fixtures: OpenRpcFixtures(c.RpcRecord)}
+	}
+	return client, nil
+}
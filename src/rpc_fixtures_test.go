@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var updateFixtures = flag.Bool("update", false, "record the fixtures of testdata/rpc again from the fake chia services")
+
+// the config of the replay tests, its services are served from testdata/rpc
+const testReplayConfig = "testdata/replay.json"
+
+// the fake chain has testChainLength blocks won alternately by the test farmers, every third block is a transaction block
+const testChainLength = 25
+
+var testFarmerPuzzleHashes = []string{"0x" + strings.Repeat("a1", 32), "0x" + strings.Repeat("b2", 32)}
+
+const testPoolPuzzleHash = "0x" + "c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3"
+
+// the sizes of the plots of the fake harvester
+var testPlotSizes = []uint64{108836000000, 108837000000}
+
+func testHeaderHash(height uint64) string {
+	return fmt.Sprintf("0x%064x", height+1)
+}
+
+func testTransactionBlock(height uint64) bool {
+	return height%3 == 0
+}
+
+// a block record as the full node returns it, the timestamp is null for blocks which are not transaction blocks
+func testBlockRecord(height uint64) map[string]interface{} {
+	prevTx := height - height%3
+	if testTransactionBlock(height) && height > 0 {
+		prevTx = height - 3
+	}
+	record := map[string]interface{}{
+		"header_hash":                   testHeaderHash(height),
+		"height":                        height,
+		"prev_hash":                     testHeaderHash(height - 1),
+		"farmer_puzzle_hash":            testFarmerPuzzleHashes[height%2],
+		"pool_puzzle_hash":              testPoolPuzzleHash,
+		"weight":                        (height + 1) * 1000,
+		"total_iters":                   (height + 1) * 100000,
+		"sub_slot_iters":                147849216,
+		"signage_point_index":           height % 64,
+		"prev_transaction_block_hash":   testHeaderHash(prevTx),
+		"prev_transaction_block_height": prevTx,
+		"timestamp":                     nil,
+	}
+	if height == 0 {
+		record["prev_hash"] = "0x" + strings.Repeat("cc", 32)
+		delete(record, "prev_transaction_block_hash")
+		delete(record, "prev_transaction_block_height")
+	}
+	if testTransactionBlock(height) {
+		record["timestamp"] = HeightToTimestamp(height)
+	}
+	return record
+}
+
+// the replies of the fake full node, wallet and harvester
+func fakeChiaService(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Start    uint64 `json:"start"`
+		End      uint64 `json:"end"`
+		WalletId uint   `json:"wallet_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reply := map[string]interface{}{"success": true}
+	switch strings.Trim(r.URL.Path, "/") {
+	case "get_blockchain_state":
+		peak := uint64(testChainLength - 1)
+		reply["blockchain_state"] = map[string]interface{}{
+			"peak":       map[string]interface{}{"header_hash": testHeaderHash(peak), "height": peak, "timestamp": HeightToTimestamp(peak)},
+			"sync":       map[string]interface{}{"synced": true, "sync_mode": false},
+			"space":      3.2e19,
+			"difficulty": 2048,
+		}
+	case "get_block_records":
+		records := []map[string]interface{}{}
+		for height := request.Start; height < request.End && height < testChainLength; height++ {
+			records = append(records, testBlockRecord(height))
+		}
+		reply["block_records"] = records
+	case "get_wallets":
+		reply["wallets"] = []map[string]interface{}{{"id": 1, "name": "Chia Wallet", "type": StandWallet}}
+	case "get_wallet_balance":
+		reply["wallet_balance"] = map[string]interface{}{"wallet_id": request.WalletId, "spendable_balance": 1750000000000, "confirmed_wallet_balance": 1750000000000}
+	case "get_farmed_amount":
+		reply["farmed_amount"] = 4000000000000
+		reply["pool_reward_amount"] = 3500000000000
+		reply["farmer_reward_amount"] = 500000000000
+		reply["fee_amount"] = 0
+		reply["last_height_farmed"] = 18
+	case "get_next_address":
+		address, _ := EncodePuzzleHash(testFarmerPuzzleHashes[0], "xch")
+		reply["wallet_id"] = request.WalletId
+		reply["address"] = address
+	case "get_plots":
+		plots := []map[string]interface{}{}
+		for index, size := range testPlotSizes {
+			plots = append(plots, map[string]interface{}{"filename": fmt.Sprintf("/plots/plot-k32-%d.plot", index), "size": 32, "file_size": size})
+		}
+		reply["plots"] = plots
+		reply["failed_to_open_file_names"] = []string{}
+		reply["not_found_filenames"] = []string{}
+	default:
+		reply = map[string]interface{}{"success": false, "error": "unknown endpoint " + r.URL.Path}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+// serves the calls with a handler in process, so the fixtures keep the host and port of the config
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	t.handler.ServeHTTP(recorder, req)
+	return recorder.Result(), nil
+}
+
+func testConfig(t testing.TB, file string, needs ConfigNeeds) *Config {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("config", file, "")
+	config, err := NewConfig(cli.NewContext(nil, set, nil), needs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// clients of the services of the replay config which send their calls through transport
+func testChiaClient(t testing.TB, config *Config, transport http.RoundTripper) *ChiaClient {
+	client, err := NewChiaClient(config, func(certFile string, keyFile string, caFile string) (*http.Client, error) {
+		return &http.Client{Transport: transport}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// the replies of the calls sync and export make to the fake services
+type testReplies struct {
+	State  *BlockchainStateResponse
+	Blocks []*GetBlockRecordsResponse
+	Wallet *WalletStats
+	Plots  uint64
+}
+
+// the ranges sync reads from the fake chain with batches of 10 blocks: the blocks after the last transaction block
+// of a batch are carried into the next one, and the peak is read again for new blocks
+var testBlockRanges = []GetBlockRecordsRequest{{Start: 0, End: 10}, {Start: 10, End: 20}, {Start: 20, End: 30}, {Start: 25, End: 35}}
+
+func testCalls(t testing.TB, client *ChiaClient) *testReplies {
+	ctx := context.Background()
+	replies := &testReplies{}
+	var err error
+	replies.State, err = client.FullNode.GetBlockchainState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range testBlockRanges {
+		blocks, err := client.FullNode.GetBlockRecords(ctx, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies.Blocks = append(replies.Blocks, blocks)
+	}
+	replies.Wallet, err = GetWalletsStats(ctx, client.Wallet, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies.Plots, err = GetPlotSize(ctx, client.Harvesters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return replies
+}
+
+// the checked-in fixtures answer like the fake services, go test -run TestRpcFixtures -update records them again
+func TestRpcFixtures(t *testing.T) {
+	config := testConfig(t, testReplayConfig, NeedFullNode|NeedWallet|NeedHarvester)
+	fake := handlerTransport{http.HandlerFunc(fakeChiaService)}
+	if *updateFixtures {
+		err := os.RemoveAll(config.RpcReplay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCalls(t, testChiaClient(t, config, &RecordTransport{Next: fake, Fixtures: OpenRpcFixtures(config.RpcReplay)}))
+	}
+	expected := testCalls(t, testChiaClient(t, config, fake))
+	replayed := testCalls(t, testChiaClient(t, config, &ReplayTransport{Fixtures: OpenRpcFixtures(config.RpcReplay)}))
+	if !reflect.DeepEqual(replayed, expected) {
+		t.Fatalf("the fixtures of %s differ from the fake services, record them again with -update", config.RpcReplay)
+	}
+}
+
+func TestRecordReplayRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpc-fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a real http round trip, failing replies are recorded too
+	server := httptest.NewServer(http.HandlerFunc(fakeChiaService))
+	defer server.Close()
+	fixtures := OpenRpcFixtures(dir)
+	record := &http.Client{Transport: &RecordTransport{Next: http.DefaultTransport, Fixtures: fixtures}}
+	replay := &http.Client{Transport: &ReplayTransport{Fixtures: fixtures}}
+
+	calls := []struct {
+		endpoint string
+		request  interface{}
+	}{
+		{"get_blockchain_state", struct{}{}},
+		{"get_block_records", GetBlockRecordsRequest{Start: 3, End: 7}},
+		{"get_plots", struct{}{}},
+		{"get_unknown", struct{}{}},
+	}
+	for _, call := range calls {
+		data, err := json.Marshal(call.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var recorded, replayed map[string]interface{}
+		recordErr := RpcFetch(context.Background(), record, server.URL+"/"+call.endpoint, string(data), &testEnvelope{Reply: &recorded})
+		replayErr := RpcFetch(context.Background(), replay, server.URL+"/"+call.endpoint, string(data), &testEnvelope{Reply: &replayed})
+		if fmt.Sprint(recordErr) != fmt.Sprint(replayErr) {
+			t.Fatalf("%s: recorded error %v, replayed error %v", call.endpoint, recordErr, replayErr)
+		}
+		if !reflect.DeepEqual(recorded, replayed) {
+			t.Fatalf("%s: recorded %v, replayed %v", call.endpoint, recorded, replayed)
+		}
+	}
+
+	// a call which was not recorded fails like an unreachable service
+	err = RpcFetch(context.Background(), replay, server.URL+"/get_blocks", "{}", &testEnvelope{})
+	if !IsRpcServiceDown(err) {
+		t.Fatalf("expected a service down error for a call which was not recorded, got %v", err)
+	}
+	// a second fixture directory replays the recorded files
+	rpcFixtures.mu.Lock()
+	delete(rpcFixtures.dirs, dir)
+	rpcFixtures.mu.Unlock()
+	var state BlockchainStateResponse
+	err = RpcFetch(context.Background(), &http.Client{Transport: &ReplayTransport{Fixtures: OpenRpcFixtures(dir)}},
+		server.URL+"/get_blockchain_state", "{}", &state)
+	if err != nil || state.BlockchainState.Peak == nil || state.BlockchainState.Peak.Height != testChainLength-1 {
+		t.Fatalf("unexpected replay of the recorded files: %+v %v", state, err)
+	}
+}
+
+// decodes a reply as a map next to the rpc response
+type testEnvelope struct {
+	RpcResponse
+	Reply *map[string]interface{}
+}
+
+func (e *testEnvelope) UnmarshalJSON(data []byte) error {
+	err := json.Unmarshal(data, &e.RpcResponse)
+	if err != nil || e.Reply == nil {
+		return err
+	}
+	return json.Unmarshal(data, e.Reply)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const DefaultRpcTimeout = 5
+const DefaultRpcRetries = 3
+const DefaultRpcBreakerFailures = 5
+const DefaultRpcBreakerCooldown = 30
+
+// retries of an idempotent call back off between these delays, with jitter
+const rpcRetryBackoffMin = 500 * time.Millisecond
+const rpcRetryBackoffMax = 10 * time.Second
+
+// seconds of the endpoints which are slower than DefaultRpcTimeout, overridden by rpc_timeouts
+var defaultRpcTimeouts = map[string]uint{
+	"get_blocks": 30,
+}
+
+// endpoints which only read, they are sent again after a failure.
+// get_next_address is not one of them, it may create an address.
+var idempotentEndpoints = map[string]bool{
+	"get_block_records":          true,
+	"get_blocks":                 true,
+	"get_additions_and_removals": true,
+	"get_blockchain_state":       true,
+	"get_wallets":                true,
+	"get_wallet_balance":         true,
+	"get_farmed_amount":          true,
+	"get_plots":                  true,
+	"get_reward_targets":         true,
+}
+
+// timeouts and retries of the rpc calls
+type RpcPolicy struct {
+	Timeout  time.Duration
+	Timeouts map[string]time.Duration
+	Retries  int
+}
+
+func NewRpcPolicy(config *Config) *RpcPolicy {
+	policy := &RpcPolicy{
+		Timeout:  time.Duration(config.RpcTimeout) * time.Second,
+		Timeouts: make(map[string]time.Duration),
+		Retries:  int(config.RpcRetries),
+	}
+	for endpoint, seconds := range defaultRpcTimeouts {
+		policy.Timeouts[endpoint] = time.Duration(seconds) * time.Second
+	}
+	for endpoint, seconds := range config.RpcTimeouts {
+		policy.Timeouts[endpoint] = time.Duration(seconds) * time.Second
+	}
+	return policy
+}
+
+func (p *RpcPolicy) EndpointTimeout(endpoint string) time.Duration {
+	timeout, ok := p.Timeouts[endpoint]
+	if ok {
+		return timeout
+	}
+	return p.Timeout
+}
+
+// seeded per process, the default source would give every process the same delays
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var jitterMu sync.Mutex
+
+// a random delay between half of and the full delay, so clients which failed together do not retry together
+func Jitter(delay time.Duration) time.Duration {
+	if delay < 2 {
+		return delay
+	}
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return delay/2 + time.Duration(jitterRand.Int63n(int64(delay/2)))
+}
+
+// the service did not answer: the connection failed, the call timed out or it replied with a server error.
+// replies of the service, including chia errors and malformed bodies, show it is up.
+func IsServiceDown(err error) bool {
+	if err == nil {
+		return false
+	}
+	var chiaError *ChiaRpcError
+	if errors.As(err, &chiaError) || ClassifyRpcError(err) == ErrorClassData {
+		return false
+	}
+	var statusError *RpcStatusError
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode >= http.StatusInternalServerError || statusError.StatusCode == http.StatusTooManyRequests
+	}
+	var openError *BreakerOpenError
+	return !errors.As(err, &openError)
+}
+
+// an rpc call failed because the service is down, unlike IsServiceDown errors of the database are not
+func IsRpcServiceDown(err error) bool {
+	var connError *RpcConnError
+	var statusError *RpcStatusError
+	return (errors.As(err, &connError) || errors.As(err, &statusError)) && IsServiceDown(err)
+}
+
+// states of a circuit breaker
+const BreakerClosed = "closed"
+const BreakerOpen = "open"
+const BreakerHalfOpen = "half-open"
+
+// a call refused because the breaker of the service is open
+type BreakerOpenError struct {
+	Name    string
+	RetryAt time.Time
+}
+
+func (e *BreakerOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker of %s is open until %s", e.Name, e.RetryAt.Format("15:04:05"))
+}
+
+type BreakerStatus struct {
+	Name      string
+	State     string
+	Failures  int
+	LastError string
+	OpenedAt  time.Time
+}
+
+// circuit breaker of one service: opened by Threshold consecutive failures, it refuses calls for Cooldown
+// and then lets a single call through, which closes it on success or opens it again on failure
+type CircuitBreaker struct {
+	Name      string
+	Threshold int
+	Cooldown  time.Duration
+	mu        sync.Mutex
+	state     string
+	failures  int
+	trial     bool
+	lastError string
+	openedAt  time.Time
+	onChange  func(status BreakerStatus)
+}
+
+func (b *CircuitBreaker) status() BreakerStatus {
+	return BreakerStatus{Name: b.Name, State: b.state, Failures: b.failures, LastError: b.lastError, OpenedAt: b.openedAt}
+}
+
+// whether a call may be sent, a *BreakerOpenError if not
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	changed := false
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.Cooldown {
+		b.state = BreakerHalfOpen
+		b.trial = false
+		changed = true
+	}
+	var err error
+	if b.state == BreakerOpen || (b.state == BreakerHalfOpen && b.trial) {
+		err = &BreakerOpenError{Name: b.Name, RetryAt: b.openedAt.Add(b.Cooldown)}
+	} else if b.state == BreakerHalfOpen {
+		b.trial = true
+	}
+	status := b.status()
+	b.mu.Unlock()
+	if changed {
+		b.report(status)
+	}
+	return err
+}
+
+// the result of an allowed call, errors of a service which is up count as success
+func (b *CircuitBreaker) Done(err error) {
+	b.mu.Lock()
+	previous := b.state
+	if IsServiceDown(err) {
+		b.failures++
+		b.lastError = err.Error()
+		if b.state == BreakerHalfOpen || b.failures >= b.Threshold {
+			b.state = BreakerOpen
+			b.openedAt = time.Now()
+		}
+	} else {
+		b.state = BreakerClosed
+		b.failures = 0
+	}
+	b.trial = false
+	status := b.status()
+	b.mu.Unlock()
+	if status.State != previous {
+		b.report(status)
+	}
+}
+
+// an allowed call was canceled by the caller, the state is kept
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+func (b *CircuitBreaker) report(status BreakerStatus) {
+	switch status.State {
+	case BreakerOpen:
+		fmt.Printf("circuit breaker of %s open after %d failures, retry in %s: %s \r\n", status.Name, status.Failures, b.Cooldown, status.LastError)
+	case BreakerHalfOpen:
+		fmt.Printf("circuit breaker of %s half-open, trying one call \r\n", status.Name)
+	default:
+		fmt.Printf("circuit breaker of %s closed \r\n", status.Name)
+	}
+	if b.onChange != nil {
+		b.onChange(status)
+	}
+}
+
+// the circuit breakers of the services called by this process, one per host and port
+type BreakerRegistry struct {
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+	onChange func(status BreakerStatus)
+}
+
+var rpcBreakers = &BreakerRegistry{breakers: make(map[string]*CircuitBreaker)}
+
+func (r *BreakerRegistry) Get(name string, config *Config) *CircuitBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	breaker, ok := r.breakers[name]
+	if !ok {
+		breaker = &CircuitBreaker{
+			Name:      name,
+			Threshold: int(config.RpcBreakerFailures),
+			Cooldown:  time.Duration(config.RpcBreakerCooldown) * time.Second,
+			state:     BreakerClosed,
+			onChange:  r.changed,
+		}
+		r.breakers[name] = breaker
+	}
+	return breaker
+}
+
+func (r *BreakerRegistry) changed(status BreakerStatus) {
+	r.mu.Lock()
+	onChange := r.onChange
+	r.mu.Unlock()
+	if onChange != nil {
+		onChange(status)
+	}
+}
+
+// call onChange on every change of a breaker's state
+func (r *BreakerRegistry) OnChange(onChange func(status BreakerStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onChange = onChange
+}
+
+// an endpoint of a service with the rpc policy and the circuit breaker of config
+func NewRpcEndpoint(config *Config, host string, port uint, client *http.Client) RpcEndpoint {
+	endpoint := RpcEndpoint{Host: host, Port: port, Client: client, Policy: NewRpcPolicy(config)}
+	endpoint.Breaker = rpcBreakers.Get(endpoint.Name(), config)
+	return endpoint
+}
+
+// send one call through the breaker with the timeout of the endpoint
+func (e *RpcEndpoint) fetch(ctx context.Context, endpoint string, url string, data string, response rpcEnvelope) error {
+	if e.Breaker != nil {
+		err := e.Breaker.Allow()
+		if err != nil {
+			return err
+		}
+	}
+	timeout := time.Duration(DefaultRpcTimeout) * time.Second
+	if e.Policy != nil {
+		timeout = e.Policy.EndpointTimeout(endpoint)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := RpcFetch(callCtx, e.Client, url, data, response)
+	if e.Breaker != nil {
+		// a call canceled by the caller says nothing about the service
+		if ctx.Err() != nil {
+			e.Breaker.Release()
+		} else {
+			e.Breaker.Done(err)
+		}
+	}
+	return err
+}
+
+// state of a circuit breaker of a service process, written on every change
+type ChiaRpcBreaker struct {
+	ID        uint64     `gorm:"primaryKey;<-:false" json:"id"`
+	Name      string     `gorm:"type:varchar(256);not null;uniqueIndex:uk_rb_name" json:"name"`
+	State     string     `gorm:"type:varchar(32);not null;default:''" json:"state"`
+	Failures  uint64     `gorm:"type:bigint(20);not null;default:0" json:"failures"`
+	LastError string     `gorm:"type:varchar(1024);not null;default:''" json:"last_error"`
+	OpenedAt  *time.Time `json:"opened_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+func SaveBreakerStatus(db *gorm.DB, status BreakerStatus) error {
+	message := status.LastError
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	breaker := ChiaRpcBreaker{Name: status.Name, State: status.State, Failures: uint64(status.Failures), LastError: message}
+	if !status.OpenedAt.IsZero() {
+		breaker.OpenedAt = &status.OpenedAt
+	}
+	r := db.Clauses(clause.OnConflict{
+		DoUpdates: clause.AssignmentColumns([]string{"state", "failures", "last_error", "opened_at", "updated_at"}),
+	}).Create(&breaker)
+	if r.Error != nil {
+		return fmt.Errorf("error save circuit breaker %s: %v", status.Name, r.Error)
+	}
+	return nil
+}
+
+func RpcBreakersAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb)
+	if err != nil {
+		return err
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+	var breakers []ChiaRpcBreaker
+	r := db.Order("name").Find(&breakers)
+	if r.Error != nil {
+		return fmt.Errorf("error read circuit breakers: %v", r.Error)
+	}
+	for _, breaker := range breakers {
+		fmt.Printf("%s %s failures: %d, since %s: %s \r\n", breaker.Name, breaker.State, breaker.Failures,
+			breaker.UpdatedAt.Format("2006-01-02 15:04:05"), breaker.LastError)
+	}
+	return nil
+}
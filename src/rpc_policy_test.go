@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	cases := []struct {
+		delay time.Duration
+		min   time.Duration
+		max   time.Duration
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{2, 1, 1},
+		{time.Second, 500 * time.Millisecond, time.Second - 1},
+		{10 * time.Second, 5 * time.Second, 10*time.Second - 1},
+	}
+	for _, c := range cases {
+		for i := 0; i < 100; i++ {
+			delay := Jitter(c.delay)
+			if delay < c.min || delay > c.max {
+				t.Fatalf("jitter of %s is %s, expected between %s and %s", c.delay, delay, c.min, c.max)
+			}
+		}
+	}
+}
+
+func TestIsServiceDown(t *testing.T) {
+	var state BlockchainStateResponse
+	dataErr := json.Unmarshal([]byte(`{"blockchain_state": []}`), &state)
+	url := "https://localhost:8555/get_blockchain_state"
+	cases := []struct {
+		name    string
+		err     error
+		down    bool
+		rpcDown bool
+	}{
+		{"no error", nil, false, false},
+		{"connection refused", &RpcConnError{Url: url, Err: errors.New("connection refused")}, true, true},
+		{"timeout", &RpcConnError{Url: url, Err: context.DeadlineExceeded}, true, true},
+		{"server error", &RpcStatusError{Url: url, StatusCode: http.StatusBadGateway}, true, true},
+		{"too many requests", &RpcStatusError{Url: url, StatusCode: http.StatusTooManyRequests}, true, true},
+		{"not found", &RpcStatusError{Url: url, StatusCode: http.StatusNotFound}, false, false},
+		{"chia error", &ChiaRpcError{Url: url, Message: "block not found"}, false, false},
+		{"malformed reply", fmt.Errorf("error decode reply: %w", dataErr), false, false},
+		{"open breaker", &BreakerOpenError{Name: "localhost:8555"}, false, false},
+		{"database error", errors.New("Error 1213: Deadlock found"), true, false},
+	}
+	for _, c := range cases {
+		if down := IsServiceDown(c.err); down != c.down {
+			t.Errorf("%s: IsServiceDown %v, expected %v", c.name, down, c.down)
+		}
+		if rpcDown := IsRpcServiceDown(c.err); rpcDown != c.rpcDown {
+			t.Errorf("%s: IsRpcServiceDown %v, expected %v", c.name, rpcDown, c.rpcDown)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	down := &RpcConnError{Url: "https://localhost:8555/get_blockchain_state", Err: errors.New("connection refused")}
+	up := &ChiaRpcError{Message: "block not found"}
+	// each step asks to call, reports the result of an allowed call and checks the state,
+	// cooled moves the opening back by the cooldown before the step
+	steps := []struct {
+		name    string
+		cooled  bool
+		allowed bool
+		result  error
+		state   string
+	}{
+		{"first failure", false, true, down, BreakerClosed},
+		{"a reply resets the failures", false, true, up, BreakerClosed},
+		{"failure 1", false, true, down, BreakerClosed},
+		{"failure 2", false, true, down, BreakerClosed},
+		{"failure 3 opens", false, true, down, BreakerOpen},
+		{"open refuses calls", false, false, nil, BreakerOpen},
+		{"trial call fails", true, true, down, BreakerOpen},
+		{"open again", false, false, nil, BreakerOpen},
+		{"trial call succeeds", true, true, nil, BreakerClosed},
+		{"closed allows calls", false, true, nil, BreakerClosed},
+	}
+	breaker := &CircuitBreaker{Name: "localhost:8555", Threshold: 3, Cooldown: time.Minute, state: BreakerClosed}
+	for _, step := range steps {
+		if step.cooled {
+			breaker.openedAt = breaker.openedAt.Add(-breaker.Cooldown)
+		}
+		err := breaker.Allow()
+		var openError *BreakerOpenError
+		if (err == nil) != step.allowed || (err != nil && !errors.As(err, &openError)) {
+			t.Fatalf("%s: allow returned %v, expected allowed %v", step.name, err, step.allowed)
+		}
+		if err == nil {
+			if breaker.state == BreakerHalfOpen && breaker.Allow() == nil {
+				t.Fatalf("%s: a second call was allowed while half-open", step.name)
+			}
+			breaker.Done(step.result)
+		}
+		if breaker.state != step.state {
+			t.Fatalf("%s: state %s, expected %s", step.name, breaker.state, step.state)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"sync"
+)
+
+// resources shared by the loops of one process: one db connection pool, one rpc client per tls identity
+// and one full node pool. they are created on first use.
+type Runtime struct {
+	Config  *Config
+	mu      sync.Mutex
+	db      *gorm.DB
+	clients map[[3]string]*http.Client
+	pool    *FullNodePool
+	chia    *ChiaClient
+}
+
+func NewRuntime(config *Config) *Runtime {
+	return &Runtime{Config: config, clients: make(map[[3]string]*http.Client)}
+}
+
+// the db, migrated when it is opened
+func (r *Runtime) Db() (*gorm.DB, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.db == nil {
+		db, err := GetDb(r.Config)
+		if err != nil {
+			return nil, err
+		}
+		r.db = db
+		// breaker changes of the services are recorded for the rpc-breakers command
+		rpcBreakers.OnChange(func(status BreakerStatus) {
+			err := SaveBreakerStatus(db, status)
+			if err != nil {
+				fmt.Printf("%v \r\n", err)
+			}
+		})
+	}
+	return r.db, nil
+}
+
+// the rpc client of a tls identity
+func (r *Runtime) RpcClient(certFile string, keyFile string, caFile string) (*http.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rpcClient(certFile, keyFile, caFile)
+}
+
+func (r *Runtime) rpcClient(certFile string, keyFile string, caFile string) (*http.Client, error) {
+	key := [3]string{certFile, keyFile, caFile}
+	client, ok := r.clients[key]
+	if !ok {
+		var err error
+		client, err = r.Config.RpcClient(certFile, keyFile, caFile)
+		if err != nil {
+			return nil, err
+		}
+		r.clients[key] = client
+	}
+	return client, nil
+}
+
+func (r *Runtime) FullNodePool() (*FullNodePool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pool == nil {
+		pool, err := newFullNodePool(r.Config, r.rpcClient)
+		if err != nil {
+			return nil, err
+		}
+		r.pool = pool
+	}
+	return r.pool, nil
+}
+
+// clients of the chia services of the config
+func (r *Runtime) ChiaClient() (*ChiaClient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.chia == nil {
+		client, err := NewChiaClient(r.Config, r.rpcClient)
+		if err != nil {
+			return nil, err
+		}
+		r.chia = client
+	}
+	return r.chia, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/urfave/cli"
+	"net"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// exit codes of the service commands
+const ExitOK = 0
+const ExitFailure = 1
+const ExitShutdownTimeout = 2
+
+// time a service loop gets to finish its in-flight batch after SIGINT or SIGTERM
+const shutdownTimeout = 30 * time.Second
+
+// margin on top of the longest wait of a loop before the systemd watchdog considers it stalled
+const heartbeatGrace = time.Minute
+
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// context canceled by SIGINT or SIGTERM, for commands which stop at the next safe point
+func SignalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), shutdownSignals...)
+}
+
+// send a state to the notify socket of systemd, a no-op when not started by systemd with Type=notify
+func SdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("error connect notify socket: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return fmt.Errorf("error notify systemd: %v", err)
+	}
+	return nil
+}
+
+// WatchdogSec of the systemd unit, 0 if the watchdog is not enabled for this process
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// liveness of a service loop for the systemd watchdog, methods are safe on nil.
+// a loop which never beats is only checked for being alive as a process.
+type Heartbeat struct {
+	deadline int64
+	ready    sync.Once
+	// called once the loop is ready instead of notifying systemd, used by the supervisor of run
+	OnReady func(status string)
+}
+
+// the loop is set up, systemd is notified once
+func (h *Heartbeat) Ready(status string) {
+	if h == nil {
+		return
+	}
+	h.ready.Do(func() {
+		if h.OnReady != nil {
+			h.OnReady(status)
+			return
+		}
+		err := SdNotify("READY=1\nSTATUS=" + status)
+		if err != nil {
+			fmt.Printf("%v \r\n", err)
+		}
+	})
+}
+
+// the loop made progress and beats again within next
+func (h *Heartbeat) Beat(next time.Duration) {
+	if h == nil {
+		return
+	}
+	atomic.StoreInt64(&h.deadline, time.Now().Add(next+heartbeatGrace).UnixNano())
+}
+
+func (h *Heartbeat) Alive() bool {
+	deadline := atomic.LoadInt64(&h.deadline)
+	return deadline == 0 || time.Now().UnixNano() < deadline
+}
+
+// ping the systemd watchdog at half of WatchdogSec while alive returns true, until ctx is done.
+// a stalled process is restarted by systemd.
+func RunWatchdog(ctx context.Context, alive func() bool) {
+	interval := SdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval / 2):
+		}
+		if !alive() {
+			fmt.Printf("service loop stalled, stop pinging the systemd watchdog \r\n")
+			continue
+		}
+		err := SdNotify("WATCHDOG=1")
+		if err != nil {
+			fmt.Printf("%v \r\n", err)
+		}
+	}
+}
+
+// run loop in a goroutine of wg, a panic is logged and cancels the service it belongs to instead of killing the process
+func GoBackground(name string, wg *sync.WaitGroup, cancel context.CancelFunc, loop func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Printf("%s panic: %v \r\n%s", name, r, debug.Stack())
+				cancel()
+			}
+		}()
+		loop()
+	}()
+}
+
+// run a service loop until it exits or SIGINT/SIGTERM is received. on a signal the context of the loop is canceled
+// and it gets shutdownTimeout to finish the in-flight batch, a second signal stops waiting.
+// the loop reports its exit code to channel, a non zero code is the exit code of the process.
+func RunService(name string, loop func(ctx context.Context, channel chan int, heartbeat *Heartbeat)) error {
+	channel := make(chan int, 1)
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, shutdownSignals...)
+	defer signal.Stop(signalChannel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	heartbeat := &Heartbeat{}
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	defer stopWatchdog()
+	go RunWatchdog(watchdogCtx, heartbeat.Alive)
+	go loop(ctx, channel, heartbeat)
+
+	code := ExitOK
+	select {
+	case sig := <-signalChannel:
+		fmt.Printf("Got %s signal. Waiting for %s to finish the current batch...\n", sig, name)
+		SdNotify("STOPPING=1")
+		cancel()
+		select {
+		case code = <-channel:
+		case sig = <-signalChannel:
+			return cli.NewExitError(fmt.Sprintf("Got %s signal again. Aborting %s", sig, name), ExitShutdownTimeout)
+		case <-time.After(shutdownTimeout):
+			return cli.NewExitError(fmt.Sprintf("%s did not stop within %s", name, shutdownTimeout), ExitShutdownTimeout)
+		}
+	case code = <-channel:
+		SdNotify("STOPPING=1")
+	}
+	if code != ExitOK {
+		return cli.NewExitError(fmt.Sprintf("%s goroutine exit with code: %d", name, code), code)
+	}
+	fmt.Printf("%s stopped\n", name)
+	return nil
+}
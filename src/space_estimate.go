@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// constants of chia's get_network_space on mainnet
+const DifficultyConstantFactor = 1 << 67
+const PlotFilterMultiplier = 1 << 9
+const UiActualSpaceConstantFactor = 0.762
+
+// z of a two-sided 95% confidence interval
+const estimateConfidenceZ = 1.96
+
+const SpaceSourceBlocks = "blocks"
+const SpaceSourceSnapshots = "snapshots"
+
+type ChiaFarmerSpaceEstimate struct {
+	ID             uint64    `gorm:"primaryKey;<-:false" json:"id"`
+	FarmerAddress  string    `gorm:"type:varchar(256);not null;uniqueIndex:uk_fse_farmer_day_window,priority:1" json:"farmer_address"`
+	Day            string    `gorm:"type:date;not null;uniqueIndex:uk_fse_farmer_day_window,priority:2" json:"day"`
+	WindowDays     uint      `gorm:"type:int;not null;uniqueIndex:uk_fse_farmer_day_window,priority:3" json:"window_days"`
+	Blocks         uint64    `gorm:"type:bigint(20);not null;default:0" json:"blocks"`
+	TotalBlocks    uint64    `gorm:"type:bigint(20);not null;default:0" json:"total_blocks"`
+	NetworkSpace   float64   `gorm:"type:double;not null;default:0" json:"network_space"`
+	EstimatedSpace float64   `gorm:"type:double;not null;default:0" json:"estimated_space"`
+	SpaceLow       float64   `gorm:"type:double;not null;default:0" json:"space_low"`
+	SpaceHigh      float64   `gorm:"type:double;not null;default:0" json:"space_high"`
+	SpaceSource    string    `gorm:"type:varchar(32);not null;default:''" json:"space_source"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// network space between two blocks, the same estimate as chia's get_network_space
+func NetworkSpaceBetween(older *ChiaBlockRecord, newer *ChiaBlockRecord) float64 {
+	if newer.TotalIters <= older.TotalIters || newer.Weight <= older.Weight {
+		return 0
+	}
+	weightDivIters := float64(newer.Weight-older.Weight) / float64(newer.TotalIters-older.TotalIters)
+	return UiActualSpaceConstantFactor * weightDivIters * DifficultyConstantFactor * PlotFilterMultiplier
+}
+
+// network space of [from, to] from the stored blocks' weight and iters, or from node snapshots
+func NetworkSpaceOfPeriod(db *gorm.DB, from uint64, to uint64) (float64, string, error) {
+	var first, last ChiaBlockRecord
+	r := db.Where("block_timestamp >= ? and block_timestamp <= ?", from, to).Order("height").Limit(1).Find(&first)
+	if r.Error == nil && r.RowsAffected > 0 {
+		r = db.Where("block_timestamp >= ? and block_timestamp <= ?", from, to).Order("height desc").Limit(1).Find(&last)
+	}
+	if r.Error != nil {
+		return 0, "", fmt.Errorf("error read blocks: %v", r.Error)
+	}
+	if r.RowsAffected > 0 {
+		space := NetworkSpaceBetween(&first, &last)
+		if space > 0 {
+			return space, SpaceSourceBlocks, nil
+		}
+	}
+
+	var snapshot struct {
+		Space float64
+		Count int64
+	}
+	r = db.Model(&ChiaBlockchainState{}).
+		Select("avg(space) as space, count(*) as count").
+		Where("created_at >= ? and created_at <= ? and space > 0", time.Unix(int64(from), 0), time.Unix(int64(to), 0)).
+		Take(&snapshot)
+	if r.Error != nil {
+		return 0, "", fmt.Errorf("error read blockchain states: %v", r.Error)
+	}
+	if snapshot.Count == 0 {
+		return 0, "", fmt.Errorf("neither stored blocks nor blockchain state snapshots cover the period")
+	}
+	return snapshot.Space, SpaceSourceSnapshots, nil
+}
+
+// 95% confidence interval of a poisson distributed count, Byar's approximation
+func PoissonInterval(count uint64) (float64, float64) {
+	k := float64(count)
+	low := 0.0
+	if count > 0 {
+		low = k * math.Pow(1-1/(9*k)-estimateConfidenceZ/(3*math.Sqrt(k)), 3)
+	}
+	high := (k + 1) * math.Pow(1-1/(9*(k+1))+estimateConfidenceZ/(3*math.Sqrt(k+1)), 3)
+	return low, high
+}
+
+// blocks won per farmer and in total during [fromDay, toDay] of timezone
+func CountWonBlocks(db *gorm.DB, fromDay string, toDay string, timezone string, farmerAddress string) (map[string]uint64, uint64, error) {
+	var rows []ChiaTotalFarmerBlocks
+	r := db.Model(&ChiaDailyFarmerBlocks{}).
+		Select("farmer_address, sum(block_count) as block_count").
+		Where("day >= ? and day <= ? and timezone = ?", fromDay, toDay, timezone).
+		Group("farmer_address").
+		Find(&rows)
+	if r.Error != nil {
+		return nil, 0, fmt.Errorf("error count won blocks: %v", r.Error)
+	}
+	won := make(map[string]uint64)
+	total := uint64(0)
+	for _, row := range rows {
+		total += row.BlockCount
+		if farmerAddress == "" || row.FarmerAddress == farmerAddress {
+			won[row.FarmerAddress] = row.BlockCount
+		}
+	}
+	if _, ok := won[farmerAddress]; farmerAddress != "" && !ok {
+		won[farmerAddress] = 0
+	}
+	return won, total, nil
+}
+
+// estimate the space of the farmers from their share of the blocks won during the windowDays days ending with day.
+// days are taken in timezone, estimates are stored in chia_farmer_space_estimates.
+func EstimateFarmerSpace(db *gorm.DB, timezone ReportTimezone, day string, windowDays uint, farmerAddress string) ([]ChiaFarmerSpaceEstimate, error) {
+	end, err := time.ParseInLocation("2006-01-02", day, timezone.Location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid day %s: %v", day, err)
+	}
+	fromDay := end.AddDate(0, 0, 1-int(windowDays)).Format("2006-01-02")
+	from, to, err := DayRangeToTimestamps(fromDay, day, timezone.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	won, total, err := CountWonBlocks(db, fromDay, day, timezone.Name, farmerAddress)
+	if err != nil {
+		return nil, err
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("no blocks won between %s and %s", fromDay, day)
+	}
+	networkSpace, source, err := NetworkSpaceOfPeriod(db, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	estimates := make([]ChiaFarmerSpaceEstimate, 0, len(won))
+	for address, blocks := range won {
+		low, high := PoissonInterval(blocks)
+		share := networkSpace / float64(total)
+		estimates = append(estimates, ChiaFarmerSpaceEstimate{
+			FarmerAddress:  address,
+			Day:            day,
+			WindowDays:     windowDays,
+			Blocks:         blocks,
+			TotalBlocks:    total,
+			NetworkSpace:   networkSpace,
+			EstimatedSpace: float64(blocks) * share,
+			SpaceLow:       low * share,
+			SpaceHigh:      high * share,
+			SpaceSource:    source,
+		})
+	}
+	if len(estimates) > 0 {
+		r := db.Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(&estimates, 1000)
+		if r.Error != nil {
+			return nil, fmt.Errorf("error save space estimates: %v", r.Error)
+		}
+	}
+	return estimates, nil
+}
+
+func FormatSpace(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	index := 0
+	for bytes >= 1024 && index < len(units)-1 {
+		bytes /= 1024
+		index++
+	}
+	return fmt.Sprintf("%.2f %s", bytes, units[index])
+}
+
+func EstimateSpaceAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb)
+	if err != nil {
+		return err
+	}
+	// daily blocks of the first reporting timezone
+	timezone := config.ReportTimezones[0]
+	day := ctx.String("day")
+	if day == "" {
+		day = time.Now().In(timezone.Location).AddDate(0, 0, -1).Format("2006-01-02")
+	}
+	var windows []uint
+	for _, value := range strings.Split(ctx.String("windows"), ",") {
+		window, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+		if err != nil || window == 0 {
+			return fmt.Errorf("invalid window %s", value)
+		}
+		windows = append(windows, uint(window))
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+
+	var all []ChiaFarmerSpaceEstimate
+	for _, window := range windows {
+		estimates, err := EstimateFarmerSpace(db, timezone, day, window, ctx.String("farmer"))
+		if err != nil {
+			return fmt.Errorf("error estimate space of %d days window: %v", window, err)
+		}
+		all = append(all, estimates...)
+	}
+	if ctx.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(all)
+	}
+	for _, estimate := range all {
+		fmt.Printf("%s %s %dd: %d/%d blocks, space: %s (95%%: %s - %s), network: %s from %s \r\n",
+			estimate.FarmerAddress, estimate.Day, estimate.WindowDays, estimate.Blocks, estimate.TotalBlocks,
+			FormatSpace(estimate.EstimatedSpace), FormatSpace(estimate.SpaceLow), FormatSpace(estimate.SpaceHigh),
+			FormatSpace(estimate.NetworkSpace), estimate.SpaceSource)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPoissonInterval(t *testing.T) {
+	// the exact 95% intervals, Byar's approximation is within 0.025 of them
+	cases := []struct {
+		count uint64
+		low   float64
+		high  float64
+	}{
+		{0, 0, 3.689},
+		{1, 0.0253, 5.572},
+		{5, 1.623, 11.668},
+		{10, 4.795, 18.390},
+		{100, 81.36, 121.63},
+		{1000, 938.97, 1063.95},
+	}
+	for _, c := range cases {
+		low, high := PoissonInterval(c.count)
+		if math.Abs(low-c.low) > 0.025 || math.Abs(high-c.high) > 0.025 {
+			t.Errorf("interval of %d is [%.4f, %.4f], expected [%.4f, %.4f]", c.count, low, high, c.low, c.high)
+		}
+	}
+}
+
+func TestNetworkSpaceBetween(t *testing.T) {
+	block := func(weight uint64, totalIters uint64) *ChiaBlockRecord {
+		return &ChiaBlockRecord{Weight: weight, TotalIters: totalIters}
+	}
+	cases := []struct {
+		name     string
+		older    *ChiaBlockRecord
+		newer    *ChiaBlockRecord
+		expected float64
+	}{
+		// a weight of 2^-40 per iteration is 2^36 of the constant factors
+		{"weight per iteration", block(1000, 1<<40), block(1000+1<<20, 1<<40+1<<60), UiActualSpaceConstantFactor * (1 << 36)},
+		{"same block", block(1000, 1<<40), block(1000, 1<<40), 0},
+		{"no new iterations", block(1000, 1<<40), block(2000, 1<<40), 0},
+		{"no new weight", block(1000, 1<<40), block(1000, 1<<41), 0},
+		{"reversed", block(2000, 1<<41), block(1000, 1<<40), 0},
+	}
+	for _, c := range cases {
+		space := NetworkSpaceBetween(c.older, c.newer)
+		if math.Abs(space-c.expected) > c.expected*1e-9 {
+			t.Errorf("%s: space %g, expected %g", c.name, space, c.expected)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/urfave/cli"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+var DefaultRunComponents = []string{"sync", "export"}
+
+// restarts of a crashed component back off between these delays
+const componentBackoffMin = 5 * time.Second
+const componentBackoffMax = 5 * time.Minute
+
+// a component which ran this long before it exited restarts without delay growth
+const componentStableAfter = 10 * time.Minute
+
+// states of a supervised component
+const ComponentStarting = "starting"
+const ComponentRunning = "running"
+const ComponentRestarting = "restarting"
+const ComponentStopped = "stopped"
+
+// a subsystem run by the run command, Run reports its exit code to channel like the loop of RunService
+type Component struct {
+	Name  string
+	Needs ConfigNeeds
+	Run   func(ctx context.Context, channel chan int, runtime *Runtime, heartbeat *Heartbeat)
+}
+
+// the components run can start, new collectors are registered here
+var Components = []*Component{
+	{Name: "sync", Needs: NeedDb | NeedFullNode, Run: SyncBlocks},
+	{Name: "export", Needs: NeedWallet | NeedHarvester, Run: ExportFarmer},
+	{Name: "collect-state", Needs: NeedDb | NeedFullNode, Run: CollectBlockchainState},
+}
+
+func FindComponent(name string) *Component {
+	for _, component := range Components {
+		if component.Name == name {
+			return component
+		}
+	}
+	return nil
+}
+
+type ComponentState struct {
+	Name      string
+	State     string
+	Status    string
+	Restarts  int
+	ExitCode  int
+	Since     time.Time
+	ready     bool
+	heartbeat *Heartbeat
+}
+
+func (c *ComponentState) String() string {
+	text := fmt.Sprintf("%s %s", c.Name, c.State)
+	if c.Status != "" && c.State == ComponentRunning {
+		text += fmt.Sprintf(" (%s)", c.Status)
+	}
+	if c.Restarts > 0 {
+		text += fmt.Sprintf(", restarts: %d, last exit code: %d", c.Restarts, c.ExitCode)
+	}
+	return text
+}
+
+// runs the enabled components in one process with a shared Runtime and restarts the crashed ones
+type Supervisor struct {
+	Runtime    *Runtime
+	components []*Component
+	states     []*ComponentState
+	mu         sync.Mutex
+	notified   bool
+}
+
+func NewSupervisor(runtime *Runtime, names []string) (*Supervisor, error) {
+	supervisor := &Supervisor{Runtime: runtime}
+	for _, name := range names {
+		component := FindComponent(name)
+		if component == nil {
+			return nil, fmt.Errorf("unknown component %s", name)
+		}
+		supervisor.components = append(supervisor.components, component)
+		supervisor.states = append(supervisor.states, &ComponentState{Name: name, State: ComponentStarting, Since: time.Now()})
+	}
+	if len(supervisor.components) == 0 {
+		return nil, fmt.Errorf("no component to run")
+	}
+	return supervisor, nil
+}
+
+// the services the enabled components use
+func (s *Supervisor) Needs() ConfigNeeds {
+	var needs ConfigNeeds
+	for _, component := range s.components {
+		needs |= component.Needs
+	}
+	return needs
+}
+
+// the state of every component
+func (s *Supervisor) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.summary()
+}
+
+func (s *Supervisor) summary() string {
+	lines := make([]string, 0, len(s.states))
+	for _, state := range s.states {
+		lines = append(lines, state.String())
+	}
+	return strings.Join(lines, "; ")
+}
+
+// apply a change of a component's state, log it and report it to systemd.
+// systemd is notified of readiness once every component has been ready.
+func (s *Supervisor) update(state *ComponentState, change func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change()
+	state.Since = time.Now()
+	fmt.Printf("component %s \r\n", state)
+	allReady := true
+	for _, other := range s.states {
+		allReady = allReady && other.ready
+	}
+	message := "STATUS=" + s.summary()
+	if allReady && !s.notified {
+		s.notified = true
+		message = "READY=1\n" + message
+	}
+	err := SdNotify(message)
+	if err != nil {
+		fmt.Printf("%v \r\n", err)
+	}
+}
+
+// true while every running component keeps beating
+func (s *Supervisor) Alive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, state := range s.states {
+		if state.State == ComponentRunning && !state.heartbeat.Alive() {
+			return false
+		}
+	}
+	return true
+}
+
+// run a component once with its own context, a panic or a return without an exit code is reported as a failure.
+// the context is canceled when the run ends, so goroutines it left behind stop before it is restarted.
+func runComponent(ctx context.Context, component *Component, runtime *Runtime, channel chan int, heartbeat *Heartbeat) {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		if r := recover(); r != nil {
+			fmt.Printf("component %s panic: %v \r\n%s", component.Name, r, debug.Stack())
+		}
+		select {
+		case channel <- ExitFailure:
+		default:
+		}
+	}()
+	component.Run(runCtx, channel, runtime, heartbeat)
+}
+
+// run a component and restart it with backoff whenever it exits, until ctx is done
+func (s *Supervisor) supervise(ctx context.Context, component *Component, state *ComponentState) {
+	backoff := &Backoff{Min: componentBackoffMin, Max: componentBackoffMax}
+	for {
+		heartbeat := &Heartbeat{}
+		heartbeat.OnReady = func(status string) {
+			s.update(state, func() {
+				state.State = ComponentRunning
+				state.Status = status
+				state.ready = true
+			})
+		}
+		s.update(state, func() {
+			state.State = ComponentStarting
+			state.heartbeat = heartbeat
+		})
+		channel := make(chan int, 1)
+		started := time.Now()
+		go runComponent(ctx, component, s.Runtime, channel, heartbeat)
+		code := <-channel
+		if ctx.Err() != nil {
+			s.update(state, func() {
+				state.State = ComponentStopped
+			})
+			return
+		}
+		if time.Since(started) >= componentStableAfter {
+			backoff.Reset()
+		}
+		delay := backoff.Next()
+		s.update(state, func() {
+			state.State = ComponentRestarting
+			state.ExitCode = code
+			state.Restarts++
+		})
+		fmt.Printf("component %s exit with code %d, restart in %s \r\n", component.Name, code, delay)
+		select {
+		case <-ctx.Done():
+			s.update(state, func() {
+				state.State = ComponentStopped
+			})
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// run every component until SIGINT or SIGTERM is received, then give them shutdownTimeout to stop
+func (s *Supervisor) Run() error {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, shutdownSignals...)
+	defer signal.Stop(signalChannel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	defer stopWatchdog()
+	go RunWatchdog(watchdogCtx, s.Alive)
+
+	var wg sync.WaitGroup
+	for index, component := range s.components {
+		wg.Add(1)
+		go func(component *Component, state *ComponentState) {
+			defer wg.Done()
+			s.supervise(ctx, component, state)
+		}(component, s.states[index])
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	sig := <-signalChannel
+	fmt.Printf("Got %s signal. Waiting for the components to finish the current batch...\n", sig)
+	SdNotify("STOPPING=1")
+	cancel()
+	select {
+	case <-stopped:
+	case sig = <-signalChannel:
+		return cli.NewExitError(fmt.Sprintf("Got %s signal again. Aborting: %s", sig, s.Summary()), ExitShutdownTimeout)
+	case <-time.After(shutdownTimeout):
+		return cli.NewExitError(fmt.Sprintf("components did not stop within %s: %s", shutdownTimeout, s.Summary()), ExitShutdownTimeout)
+	}
+	fmt.Printf("run stopped\n")
+	return nil
+}
+
+func RunAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, 0)
+	if err != nil {
+		return err
+	}
+	names := config.RunComponents
+	if ctx.IsSet("components") {
+		names = strings.Split(ctx.String("components"), ",")
+	}
+	supervisor, err := NewSupervisor(NewRuntime(config), names)
+	if err != nil {
+		return err
+	}
+	err = config.Validate(supervisor.Needs())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("run components: %s \r\n", strings.Join(names, ", "))
+	return supervisor.Run()
+}
@@ -6,133 +6,415 @@ import (
 	"fmt"
 	"github.com/urfave/cli"
 	"gorm.io/gorm"
-	"os"
-	"os/signal"
+	"sync"
 	"time"
 )
 
+// the cursor of block ingestion
 func GetSyncedHeight(db *gorm.DB) (*ChiaBlockSyncHeight, error) {
-	var blockHeight ChiaBlockSyncHeight
-	r := db.Last(&blockHeight)
-	if r.Error == nil {
-		return &blockHeight, nil
-	} else if errors.Is(r.Error, gorm.ErrRecordNotFound) {
-		return nil, nil
-	} else {
-		return nil, fmt.Errorf("error get latest block: %v", r.Error)
+	return GetCursor(db, CursorBlocks)
+}
+
+// fill the farmer and pool addresses of a batch of block records and count their contribution to the aggregates.
+// timestamps must be interpolated already. prev is the block before the batch, nil if it is unknown,
+// its weight gives the difficulty of the first block.
+func CountBlockRecords(blocks []ChiaBlockRecord, prev *ChiaBlockRecord, config *Config) (*FarmerBlockCounts, *EpochCounts, error) {
+	counts := NewFarmerBlockCounts(config.ReportTimezones)
+	epochs := NewEpochCounts()
+	for index, block := range blocks {
+		farmerAddress, err := EncodePuzzleHash(block.FarmerPuzzleHash, "xch")
+		if err == nil {
+			counts.Add(farmerAddress, blocks[index].BlockTimestamp)
+			difficulty := uint64(0)
+			if index > 0 {
+				difficulty = block.Weight - blocks[index-1].Weight
+			} else if prev != nil && prev.Height+1 == block.Height && block.Weight > prev.Weight {
+				difficulty = block.Weight - prev.Weight
+			}
+			epochs.Add(&blocks[index], farmerAddress, difficulty)
+			blocks[index].FarmerAddress = farmerAddress
+			// older versions encoded the farmer puzzle hash here, the records they stored need a resync
+			poolAddress, err := EncodePuzzleHash(block.PoolPuzzleHash, "xch")
+			if err == nil {
+				blocks[index].PoolAddress = poolAddress
+			} else {
+				fmt.Printf("error encode pool puzzle hash:%v \r\n", err)
+			}
+		} else {
+			return nil, nil, DataError(block.Height, fmt.Errorf("error encode farmer puzzle hash of block %d: %v", block.Height, err))
+		}
 	}
+	return counts, epochs, nil
 }
 
-func SyncBlocks(ctx context.Context, channel chan int, config *Config) {
+// apply a batch of block records to the farmer aggregates and the sync height.
+// prev is the block before the batch and prevTx the last transaction block before it, used to interpolate the missing timestamps.
+func ApplyBlockRecords(blocks []ChiaBlockRecord, prev *ChiaBlockRecord, prevTx *ChiaBlockRecord, config *Config, tx *gorm.DB) error {
+	InterpolateTimestamps(blocks, prevTx)
+	err := StoreBlockRecords(blocks, prev, config, tx)
+	if err != nil {
+		return err
+	}
+	last := blocks[len(blocks)-1]
+	err = LogSyncHeight(last.Height, last.HeaderHash, tx)
+	if err != nil {
+		return fmt.Errorf("error log sync height: %v", err)
+	}
+	return nil
+}
 
-	db, err := GetDb(config)
+// add a batch of block records with interpolated timestamps to the farmer aggregates and the epoch statistics,
+// and store them with sync_blocks or keep them as the recent blocks otherwise, the watched ones are stored in watchlist mode
+func StoreBlockRecords(blocks []ChiaBlockRecord, prev *ChiaBlockRecord, config *Config, tx *gorm.DB) error {
+	counts, epochs, err := CountBlockRecords(blocks, prev, config)
+	if err != nil {
+		return err
+	}
+	err = UpsertFarmerBlocks(counts, tx)
+	if err != nil {
+		return err
+	}
+	err = UpsertEpochStats(epochs, tx)
+	if err != nil {
+		return err
+	}
+	if config.SyncBlocks {
+		r := tx.Create(&blocks)
+		if r.Error != nil {
+			return fmt.Errorf("error save block records: %v", r.Error)
+		}
+	} else {
+		err = StoreRecentBlocks(blocks, config, tx)
+		if err != nil {
+			return err
+		}
+	}
+	if config.WatchlistMode {
+		err = SaveWatchedBlocks(blocks, config, tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// follow the chain until ctx is done, the batch being committed is finished before the exit code is sent to channel
+func SyncBlocks(ctx context.Context, channel chan int, runtime *Runtime, heartbeat *Heartbeat) {
+	config := runtime.Config
+	// the background loops of a run stop with it, also when it fails or a background loop fails
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	db, err := runtime.Db()
 	if err != nil {
 		fmt.Printf("error open db connection: %v \r\n", err)
-		channel <- 1
+		channel <- ExitFailure
 		return
 	}
+	// reads and background checks are canceled on shutdown, batch transactions use db and are finished
+	live := db.WithContext(ctx)
 
-	blockHeight, err := GetSyncedHeight(db)
+	blockHeight, err := GetSyncedHeight(live)
 	if err != nil {
+		fmt.Printf("error get synced height: %v \r\n", err)
+		channel <- ExitFailure
 		return
 	}
 	start := uint64(0)
+	prevHash := ""
 	if blockHeight != nil {
 		start = start + blockHeight.Height + 1
+		prevHash = blockHeight.HeaderHash
 	}
 
-	client, err := RpcClient(config.PrivateCert, config.PrivateKey, config.CaCert)
+	pool, err := runtime.FullNodePool()
 	if err == nil {
 		batch := uint64(10)
 		interval := 20
+		peaks := make(chan uint64, 1)
+		var prevBlock, prevTx *ChiaBlockRecord
+		var background sync.WaitGroup
+		// a panic of the loop is reported after the background loops stopped
+		defer func() {
+			cancel()
+			background.Wait()
+		}()
+		// replayed runs poll the recorded full node only
+		if config.Daemon.Port != 0 && config.RpcReplay == "" {
+			GoBackground("watch new peaks", &background, cancel, func() {
+				WatchNewPeaks(ctx, config, peaks)
+			})
+		}
+		if config.SyncBlocks {
+			for _, pipeline := range EnabledPipelines(config) {
+				pipeline := pipeline
+				GoBackground("pipeline "+pipeline.Name, &background, cancel, func() {
+					FollowPipeline(ctx, config, live, pool, pipeline, time.Duration(interval)*time.Second)
+				})
+			}
+			GoBackground("integrity checker", &background, cancel, func() {
+				RunIntegrityChecks(ctx, config, live, pool, time.Duration(config.IntegrityCheckInterval)*time.Second)
+			})
+		} else if len(EnabledPipelines(config)) > 0 {
+			fmt.Printf("derived pipelines read the stored block records, enable sync_blocks to run them \r\n")
+		}
+		backoff := &Backoff{Min: syncBackoffMin, Max: syncBackoffMax}
+		// when set, batches end before it to isolate a block which fails to be processed
+		limit := uint64(0)
+		// blocks from start after the last transaction block of a batch wait for the next batch to interpolate their timestamps
+		var carry []ChiaBlockRecord
+		heartbeat.Ready(fmt.Sprintf("syncing from height %d", start))
 		for true {
-			end := start + batch
-			result := &GetBlocksResponse{}
-			err = GetBlockRecords(client, config.RpcHost, config.FullNodeRpcPort, start, end, result)
+			if ctx.Err() != nil {
+				background.Wait()
+				if parent.Err() == nil {
+					fmt.Printf("sync stopped at height %d after a background loop failed \r\n", start-1)
+					channel <- ExitFailure
+					return
+				}
+				fmt.Printf("sync stopped at height %d \r\n", start-1)
+				channel <- ExitOK
+				return
+			}
+			heartbeat.Beat(syncBackoffMax)
+			node, err := pool.Node(ctx)
 			if err != nil {
-				fmt.Printf("error GetBlockRecords: %v", err)
+				fmt.Printf("error select full node: %v \r\n", err)
+				backoff.Wait(ctx)
+				continue
+			}
+			isolating := limit > start
+			if isolating {
+				carry = nil
+			}
+			read := start + uint64(len(carry))
+			end := read + batch
+			if isolating && limit < end {
+				end = limit
+			}
+			result, err := node.GetBlockRecords(ctx, GetBlockRecordsRequest{Start: read, End: end})
+			if err != nil {
+				if ctx.Err() != nil {
+					continue
+				}
+				if len(carry) > 0 {
+					// read the batch again from start
+					carry = nil
+					continue
+				}
+				class := ClassifyRpcError(err)
+				fmt.Printf("error GetBlockRecords from %s (%s): %v \r\n", node.Name(), class, err)
+				if class == ErrorClassData {
+					if end-start > 1 {
+						// read block by block to find the malformed one
+						limit = start + 1
+						continue
+					}
+					if quarantineFailedBlock(ctx, config, db, backoff, start, "", class, err) {
+						start, prevHash = start+1, ""
+					}
+					continue
+				}
+				next, err := pool.Failover(ctx)
+				if err != nil || next == node {
+					backoff.Wait(ctx)
+				}
 			} else if len(result.BlockRecords) > 0 {
-				doneWithHistory := uint64(len(result.BlockRecords)) < batch
-				// begin Transaction
-				err = db.Transaction(func(tx *gorm.DB) error {
-					for index, block := range result.BlockRecords {
-						farmerAddress, err := EncodePuzzleHash(block.FarmerPuzzleHash, "xch")
+				blocks := append(append([]ChiaBlockRecord(nil), carry...), result.BlockRecords...)
+				carry = nil
+				if !BlocksLinked(prevHash, blocks) {
+					if prevHash != "" && blocks[0].PrevHash != prevHash {
+						resumeHeight, resumeHash, err := HandleReorg(ctx, node, config, live, start-1)
 						if err == nil {
-							err = IncreaseTotalBlock(farmerAddress, tx)
-							if err != nil {
-								return fmt.Errorf("error increase total blocks")
-							}
-
-							if doneWithHistory && block.BlockTimestamp == 0 {
-								result.BlockRecords[index].BlockTimestamp = uint64(time.Now().Unix())
-							} else if block.BlockTimestamp == 0 {
-								result.BlockRecords[index].BlockTimestamp = HeightToTimestamp(block.Height)
-							}
-
-							timestamp := result.BlockRecords[index].BlockTimestamp
-							err = IncreaseDailyBlock(farmerAddress, timestamp, tx)
-							if err != nil {
-								return fmt.Errorf("error calculate daily blocks")
-							}
-							if config.SyncBlocks {
-								result.BlockRecords[index].FarmerAddress = farmerAddress
-								poolAddress, err := EncodePuzzleHash(block.FarmerPuzzleHash, "xch")
-								if err == nil {
-									result.BlockRecords[index].PoolAddress = poolAddress
-								} else {
-									fmt.Printf("error encode pool puzzle hash:%v \r\n", err)
-								}
-								result.BlockRecords[index].IsTransactionBlock = block.BlockTimestamp != 0
-							}
+							start, prevHash = resumeHeight, resumeHash
 						} else {
-							return fmt.Errorf("error encode farmer puzzle hash:%v \r\n", err)
+							fmt.Printf("error handle chain reorg: %v \r\n", err)
+							backoff.Wait(ctx)
 						}
+					} else {
+						// the chain changed while reading the batch, read it again after the backoff
+						fmt.Printf("blocks from height %d from %s are not linked, read them again \r\n", start, node.Name())
+						backoff.Wait(ctx)
 					}
-					if config.SyncBlocks {
-						tx.Create(&result.BlockRecords)
+					continue
+				}
+				doneWithHistory := uint64(len(result.BlockRecords)) < end-read
+				var tail []ChiaBlockRecord
+				if doneWithHistory || !isolating {
+					// wait for the next transaction block to interpolate the timestamps of the latest blocks,
+					// they are read again at the peak and carried into the next batch otherwise
+					blocks, tail = SplitAtLastTransactionBlock(blocks)
+					if doneWithHistory {
+						tail = nil
 					}
-					length := uint64(len(result.BlockRecords))
-					err = LogSyncHeight(start+length-1, tx)
-					if err == nil {
-						start += length
-					} else {
-						return fmt.Errorf("error log sync height: %v", err)
+					if len(blocks) == 0 {
+						carry = tail
+						if doneWithHistory {
+							WaitForNewPeak(ctx, peaks, time.Duration(interval)*time.Second)
+						}
+						continue
+					}
+				}
+				if config.CrossCheckHeaderHash {
+					confirmed, disagreeing := CrossCheckBatch(ctx, pool, node, blocks, live)
+					if disagreeing != nil {
+						pool.Exclude(ctx, disagreeing)
 					}
-					return nil
+					if !confirmed {
+						WaitForNewPeak(ctx, peaks, time.Duration(interval)*time.Second)
+						continue
+					}
+				}
+				prevTx, err = PrevTransactionBlock(ctx, node, live, &blocks[0], prevTx)
+				if err != nil {
+					fmt.Printf("error get previous transaction block: %v \r\n", err)
+					backoff.Wait(ctx)
+					continue
+				}
+				prevBlock, err = PrevBlock(ctx, node, live, &blocks[0], prevBlock)
+				if err != nil {
+					fmt.Printf("error get previous block: %v \r\n", err)
+					backoff.Wait(ctx)
+					continue
+				}
+				// begin Transaction
+				err = AggregatesTransaction(db, func(tx *gorm.DB) error {
+					return ApplyBlockRecords(blocks, prevBlock, prevTx, config, tx)
 				})
-				if len(result.BlockRecords) < 10 {
-					time.Sleep(time.Duration(interval) * time.Second)
+				if err == nil {
+					backoff.Reset()
+					last := blocks[len(blocks)-1]
+					start = last.Height + 1
+					prevHash = last.HeaderHash
+					prevBlock = &last
+					prevTx = LastTransactionBlock(blocks, prevTx)
+					carry = tail
+					if doneWithHistory {
+						WaitForNewPeak(ctx, peaks, time.Duration(interval)*time.Second)
+					}
+					continue
+				}
+				class := ClassifyError(err)
+				fmt.Printf("error sync blocks (%s): %v \r\n", class, err)
+				var syncError *SyncError
+				if class == ErrorClassData && errors.As(err, &syncError) && syncError.Height > start {
+					// commit the blocks before the failing one first
+					limit = syncError.Height
+					continue
+				}
+				if class == ErrorClassData && quarantineFailedBlock(ctx, config, db, backoff, start, blocks[0].HeaderHash, class, err) {
+					start, prevHash = start+1, blocks[0].HeaderHash
+					prevTx = LastTransactionBlock(blocks[:1], prevTx)
+				} else if class != ErrorClassData {
+					backoff.Wait(ctx)
 				}
-
 			} else {
-				time.Sleep(time.Duration(interval) * time.Second)
+				// at the peak the carried blocks are read again with the next transaction block
+				carry = nil
+				WaitForNewPeak(ctx, peaks, time.Duration(interval)*time.Second)
 			}
 		}
 	} else {
 		fmt.Printf("error create rcp client: %v \r\n", err)
-		channel <- 1
+		channel <- ExitFailure
 	}
 }
-func SyncAction(ctx *cli.Context) error {
 
-	syncChannel := make(chan int)
-	signalChannel := make(chan os.Signal)
-	defer close(signalChannel)
-	defer close(syncChannel)
+// after a data error of the block at height, wait for the backoff or quarantine the block once it failed
+// quarantine_after times with quarantine_blocks. returns true if the block was quarantined and sync moves past it.
+func quarantineFailedBlock(ctx context.Context, config *Config, db *gorm.DB, backoff *Backoff, height uint64, headerHash string, class string, reason error) bool {
+	if config.QuarantineBlocks && uint(backoff.Attempts+1) >= config.QuarantineAfter {
+		err := QuarantineBlock(db, height, headerHash, class, reason, backoff.Attempts+1)
+		if err == nil {
+			backoff.Reset()
+			return true
+		}
+		fmt.Printf("%v \r\n", err)
+	}
+	backoff.Wait(ctx)
+	return false
+}
 
-	config, err := NewConfig(ctx)
+// compare the header hashes of a batch with a second full node before it is committed, the mismatches are logged
+// and recorded in chia_header_hash_mismatches. on a mismatch the other full nodes break the tie: the batch is confirmed
+// if one of them agrees with node, and the node they disagree with is returned to be excluded. the blocks within
+// crossCheckConfirmations of the peak may still change, so no node is excluded for them. without a third node
+// the batch stays unconfirmed and is read again after the next peak.
+// without a reachable second node the batch is committed unchecked.
+func CrossCheckBatch(ctx context.Context, pool *FullNodePool, node *FullNodeClient, blocks []ChiaBlockRecord, db *gorm.DB) (bool, *FullNodeClient) {
+	checks := pool.CheckNodes(node)
+	if len(checks) == 0 {
+		fmt.Printf("no second full node to cross check blocks %d-%d \r\n", blocks[0].Height, blocks[len(blocks)-1].Height)
+		return true, nil
+	}
+	check := checks[0]
+	mismatches, err := CrossCheckBlocks(ctx, node, check.Node, blocks)
 	if err != nil {
-		return err
+		fmt.Printf("error cross check blocks with %s: %v \r\n", check.Node.Name(), err)
+		return true, nil
+	}
+	if len(mismatches) == 0 {
+		return true, nil
+	}
+	err = LogHeaderHashMismatches(mismatches, db)
+	if err != nil {
+		fmt.Printf("%v \r\n", err)
 	}
 
-	go SyncBlocks(context.Background(), syncChannel, config)
+	disputed := make([]ChiaBlockRecord, 0, len(mismatches))
+	checkHashes := make(map[uint64]string, len(mismatches))
+	for _, mismatch := range mismatches {
+		checkHashes[mismatch.Height] = mismatch.CheckHeaderHash
+		for _, block := range blocks {
+			if block.Height == mismatch.Height {
+				disputed = append(disputed, block)
+			}
+		}
+	}
+	last := disputed[len(disputed)-1].Height
+	for _, tiebreak := range checks[1:] {
+		if tiebreak.Peak < last {
+			continue
+		}
+		against, err := CrossCheckBlocks(ctx, node, tiebreak.Node, disputed)
+		if err != nil {
+			fmt.Printf("error cross check blocks with %s: %v \r\n", tiebreak.Node.Name(), err)
+			continue
+		}
+		err = LogHeaderHashMismatches(against, db)
+		if err != nil {
+			fmt.Printf("%v \r\n", err)
+		}
+		agreesWithCheck := len(against) == len(disputed)
+		for _, mismatch := range against {
+			agreesWithCheck = agreesWithCheck && mismatch.CheckHeaderHash == checkHashes[mismatch.Height]
+		}
+		var disagreeing *FullNodeClient
+		if len(against) == 0 {
+			fmt.Printf("%s agrees with %s on blocks %d-%d, %s differs \r\n", tiebreak.Node.Name(), node.Name(), disputed[0].Height, last, check.Node.Name())
+			disagreeing = check.Node
+		} else if agreesWithCheck {
+			fmt.Printf("%s agrees with %s on blocks %d-%d, %s differs \r\n", tiebreak.Node.Name(), check.Node.Name(), disputed[0].Height, last, node.Name())
+			disagreeing = node
+		} else {
+			continue
+		}
+		if last+crossCheckConfirmations > tiebreak.Peak {
+			disagreeing = nil
+		}
+		return len(against) == 0, disagreeing
+	}
+	fmt.Printf("no third full node breaks the tie of blocks %d-%d between %s and %s, read them again after the next peak \r\n",
+		disputed[0].Height, last, node.Name(), check.Node.Name())
+	return false, nil
+}
 
-	signal.Notify(signalChannel, os.Interrupt)
-	select {
-	case sig := <-signalChannel:
-		fmt.Printf("Got %s signal. Aborting...\n", sig)
-	case code := <-syncChannel:
-		fmt.Printf("sync goroutine exit with code: %d\n", code)
+func SyncAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb|NeedFullNode)
+	if err != nil {
+		return err
 	}
-	return nil
+	return RunService("sync", func(runCtx context.Context, channel chan int, heartbeat *Heartbeat) {
+		SyncBlocks(runCtx, channel, NewRuntime(config), heartbeat)
+	})
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// sync the fake chain of testdata/rpc from genesis into the test database, whose sync tables are emptied first
+func TestSyncBlocksReplay(t *testing.T) {
+	dsn := os.Getenv(testDsnEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDsnEnv)
+	}
+	config := testConfig(t, testReplayConfig, NeedFullNode)
+	config.Dsn = dsn
+	runtime := NewRuntime(config)
+	db, err := runtime.Db()
+	if err != nil {
+		t.Fatal(err)
+	}
+	models := []interface{}{&ChiaBlockSyncHeight{}, &ChiaTotalFarmerBlocks{}, &ChiaEpochStats{}, &ChiaEpochFarmerBlocks{},
+		&ChiaBlockRecord{}, &ChiaQuarantinedBlock{}, &ChiaReorgLog{}}
+	for _, granularity := range Granularities {
+		models = append(models, granularity.Model)
+	}
+	for _, model := range models {
+		r := db.Where("1 = 1").Delete(model)
+		if r.Error != nil {
+			t.Fatal(r.Error)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	channel := make(chan int, 1)
+	go SyncBlocks(ctx, channel, runtime, nil)
+
+	// the last block of the fake chain is a transaction block, so every block is committed
+	peak := uint64(testChainLength - 1)
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		synced, err := GetSyncedHeight(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if synced != nil && synced.Height == peak {
+			if synced.HeaderHash != testHeaderHash(peak) {
+				t.Fatalf("synced header hash %s, expected %s", synced.HeaderHash, testHeaderHash(peak))
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sync did not reach height %d: %+v", peak, synced)
+		}
+		select {
+		case code := <-channel:
+			t.Fatalf("sync exited with %d", code)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	cancel()
+	select {
+	case code := <-channel:
+		if code != ExitOK {
+			t.Fatalf("sync exited with %d", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("sync did not stop")
+	}
+
+	// the farmers won the even and the odd heights
+	for index, puzzleHash := range testFarmerPuzzleHashes {
+		address, err := EncodePuzzleHash(puzzleHash, "xch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := uint64(testChainLength / 2)
+		if index == 0 {
+			expected = testChainLength - expected
+		}
+		var total ChiaTotalFarmerBlocks
+		r := db.Where("farmer_address = ?", address).Take(&total)
+		if r.Error != nil {
+			t.Fatalf("error read total blocks of %s: %v", address, r.Error)
+		}
+		if total.BlockCount != expected {
+			t.Fatalf("%s won %d blocks, expected %d", address, total.BlockCount, expected)
+		}
+	}
+}
+
+// the first block of a batch takes its difficulty from the block before the batch
+func TestCountBlockRecordsDifficulty(t *testing.T) {
+	timezones, err := LoadReportTimezones(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{ReportTimezones: timezones}
+	block := func(height uint64, weight uint64) ChiaBlockRecord {
+		return ChiaBlockRecord{Height: height, Weight: weight, FarmerPuzzleHash: testFarmerPuzzleHashes[0], PoolPuzzleHash: testPoolPuzzleHash,
+			BlockTimestamp: HeightToTimestamp(height)}
+	}
+	epochStart := uint64(EpochBlocks)
+	cases := []struct {
+		name       string
+		blocks     []ChiaBlockRecord
+		prev       *ChiaBlockRecord
+		difficulty uint64
+	}{
+		{"from the previous batch", []ChiaBlockRecord{block(epochStart, 5000)}, &ChiaBlockRecord{Height: epochStart - 1, Weight: 3000}, 2000},
+		{"within the batch", []ChiaBlockRecord{block(epochStart, 5000), block(epochStart+1, 7000)}, nil, 2000},
+		{"unknown previous block", []ChiaBlockRecord{block(epochStart, 5000)}, nil, 0},
+		{"not the previous height", []ChiaBlockRecord{block(epochStart, 5000)}, &ChiaBlockRecord{Height: epochStart - 2, Weight: 1000}, 0},
+	}
+	for _, c := range cases {
+		_, epochs, err := CountBlockRecords(c.blocks, c.prev, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if difficulty := epochs.Stats[1].Difficulty; difficulty != c.difficulty {
+			t.Errorf("%s: difficulty %d, expected %d", c.name, difficulty, c.difficulty)
+		}
+	}
+}
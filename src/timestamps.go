@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/urfave/cli"
+	"gorm.io/gorm"
+)
+
+// target duration of a sub slot, sub_slot_iters are adjusted so a sub slot takes 600 seconds
+const SubSlotSeconds = 600
+const fixTimestampsBatch = 1000
+
+// fill the timestamps of non transaction blocks, only transaction blocks carry a timestamp.
+// the timestamp is interpolated by total iters between the previous and the next transaction block,
+// blocks after the last transaction block are extrapolated from the previous one with the target sub slot time.
+// prevTx is the last transaction block before blocks, without it leading blocks fall back to HeightToTimestamp.
+func InterpolateTimestamps(blocks []ChiaBlockRecord, prevTx *ChiaBlockRecord) {
+	for index := range blocks {
+		blocks[index].IsTransactionBlock = blocks[index].BlockTimestamp != 0
+	}
+	nextTx := make([]*ChiaBlockRecord, len(blocks))
+	var next *ChiaBlockRecord
+	for index := len(blocks) - 1; index >= 0; index-- {
+		nextTx[index] = next
+		if blocks[index].IsTransactionBlock {
+			next = &blocks[index]
+		}
+	}
+
+	prev := prevTx
+	for index := range blocks {
+		block := &blocks[index]
+		if block.IsTransactionBlock {
+			prev = block
+			continue
+		}
+		block.BlockTimestamp = EstimateTimestamp(block, prev, nextTx[index])
+	}
+}
+
+// timestamp of a non transaction block from its neighbouring transaction blocks, either may be nil
+func EstimateTimestamp(block *ChiaBlockRecord, prev *ChiaBlockRecord, next *ChiaBlockRecord) uint64 {
+	if prev != nil && next != nil && next.TotalIters > prev.TotalIters && next.BlockTimestamp >= prev.BlockTimestamp &&
+		block.TotalIters >= prev.TotalIters && block.TotalIters <= next.TotalIters {
+		ratio := float64(block.TotalIters-prev.TotalIters) / float64(next.TotalIters-prev.TotalIters)
+		return prev.BlockTimestamp + uint64(ratio*float64(next.BlockTimestamp-prev.BlockTimestamp))
+	}
+	if prev != nil && block.SubSlotIters > 0 && block.TotalIters >= prev.TotalIters {
+		return prev.BlockTimestamp + (block.TotalIters-prev.TotalIters)*SubSlotSeconds/block.SubSlotIters
+	}
+	if next != nil && block.SubSlotIters > 0 && next.TotalIters >= block.TotalIters {
+		elapsed := (next.TotalIters - block.TotalIters) * SubSlotSeconds / block.SubSlotIters
+		if elapsed < next.BlockTimestamp {
+			return next.BlockTimestamp - elapsed
+		}
+	}
+	return HeightToTimestamp(block.Height)
+}
+
+// split blocks after the last transaction block, the tail can not be interpolated until the next transaction block is known.
+// timestamps of non transaction blocks must not be filled yet.
+func SplitAtLastTransactionBlock(blocks []ChiaBlockRecord) ([]ChiaBlockRecord, []ChiaBlockRecord) {
+	for index := len(blocks) - 1; index >= 0; index-- {
+		if blocks[index].BlockTimestamp != 0 {
+			return blocks[:index+1], blocks[index+1:]
+		}
+	}
+	return nil, blocks
+}
+
+// the last transaction block of blocks, or prevTx if there is none
+func LastTransactionBlock(blocks []ChiaBlockRecord, prevTx *ChiaBlockRecord) *ChiaBlockRecord {
+	for index := len(blocks) - 1; index >= 0; index-- {
+		if blocks[index].IsTransactionBlock {
+			last := blocks[index]
+			return &last
+		}
+	}
+	return prevTx
+}
+
+// the transaction block before block, from cached, the stored block records or the full node
+func PrevTransactionBlock(ctx context.Context, node *FullNodeClient, db *gorm.DB, block *ChiaBlockRecord, cached *ChiaBlockRecord) (*ChiaBlockRecord, error) {
+	if block.BlockTimestamp != 0 {
+		return cached, nil
+	}
+	if cached != nil && cached.HeaderHash == block.PrevTransactionBlockHash {
+		return cached, nil
+	}
+	var stored ChiaBlockRecord
+	r := db.Where("header_hash = ?", block.PrevTransactionBlockHash).Limit(1).Find(&stored)
+	if r.Error != nil {
+		return nil, fmt.Errorf("error read transaction block: %v", r.Error)
+	}
+	if r.RowsAffected > 0 && stored.IsTransactionBlock {
+		return &stored, nil
+	}
+	height := block.PrevTransactionBlockHeight
+	result, err := node.GetBlockRecords(ctx, GetBlockRecordsRequest{Start: height, End: height + 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.BlockRecords) != 1 || result.BlockRecords[0].BlockTimestamp == 0 {
+		return nil, fmt.Errorf("transaction block of height %d not found", height)
+	}
+	prevTx := result.BlockRecords[0]
+	prevTx.IsTransactionBlock = true
+	return &prevTx, nil
+}
+
+// the block before block, from cached, the stored block records or the full node, nil for the genesis block
+func PrevBlock(ctx context.Context, node *FullNodeClient, db *gorm.DB, block *ChiaBlockRecord, cached *ChiaBlockRecord) (*ChiaBlockRecord, error) {
+	if block.Height == 0 {
+		return nil, nil
+	}
+	if cached != nil && cached.HeaderHash == block.PrevHash {
+		return cached, nil
+	}
+	var stored ChiaBlockRecord
+	r := db.Where("header_hash = ?", block.PrevHash).Limit(1).Find(&stored)
+	if r.Error != nil {
+		return nil, fmt.Errorf("error read block: %v", r.Error)
+	}
+	if r.RowsAffected > 0 {
+		return &stored, nil
+	}
+	result, err := node.GetBlockRecords(ctx, GetBlockRecordsRequest{Start: block.Height - 1, End: block.Height})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.BlockRecords) != 1 || result.BlockRecords[0].HeaderHash != block.PrevHash {
+		return nil, fmt.Errorf("block of height %d not found", block.Height-1)
+	}
+	prev := result.BlockRecords[0]
+	return &prev, nil
+}
+
+// interpolate the timestamps of stored non transaction blocks of [fromHeight, toHeight] again
+// and move their counts to the corrected periods.
+func FixTimestamps(db *gorm.DB, config *Config, fromHeight uint64, toHeight uint64) (uint64, error) {
+	var prevTx *ChiaBlockRecord
+	var carry []ChiaBlockRecord
+	original := make(map[uint64]uint64)
+	fixed := uint64(0)
+	for start := fromHeight; start <= toHeight; start += fixTimestampsBatch {
+		end := start + fixTimestampsBatch - 1
+		if end > toHeight {
+			end = toHeight
+		}
+		var stored []ChiaBlockRecord
+		r := db.Where("height >= ? and height <= ?", start, end).Order("height").Find(&stored)
+		if r.Error != nil {
+			return fixed, fmt.Errorf("error read blocks: %v", r.Error)
+		}
+		if prevTx == nil && start > 0 {
+			var last ChiaBlockRecord
+			r = db.Where("height < ? and is_transaction_block = ?", start, true).Order("height desc").Limit(1).Find(&last)
+			if r.Error != nil {
+				return fixed, fmt.Errorf("error read transaction block: %v", r.Error)
+			}
+			if r.RowsAffected > 0 {
+				prevTx = &last
+			}
+		}
+
+		// clear the estimated timestamps so they are interpolated again
+		for index := range stored {
+			original[stored[index].ID] = stored[index].BlockTimestamp
+			if !stored[index].IsTransactionBlock {
+				stored[index].BlockTimestamp = 0
+			}
+		}
+		blocks := append(carry, stored...)
+		if end < toHeight {
+			blocks, carry = SplitAtLastTransactionBlock(blocks)
+		} else {
+			carry = nil
+		}
+		InterpolateTimestamps(blocks, prevTx)
+		n, err := saveFixedTimestamps(db, config, blocks, original)
+		if err != nil {
+			return fixed, err
+		}
+		fixed += n
+		prevTx = LastTransactionBlock(blocks, prevTx)
+		for _, block := range blocks {
+			delete(original, block.ID)
+		}
+	}
+	return fixed, nil
+}
+
+// update the timestamps which differ from the original ones and move the counts of these blocks to their new periods
+func saveFixedTimestamps(db *gorm.DB, config *Config, blocks []ChiaBlockRecord, original map[uint64]uint64) (uint64, error) {
+	fixed := uint64(0)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		moveFrom := NewFarmerBlockCounts(config.ReportTimezones)
+		moveTo := NewFarmerBlockCounts(config.ReportTimezones)
+		for _, block := range blocks {
+			timestamp := original[block.ID]
+			if block.BlockTimestamp == timestamp {
+				continue
+			}
+			r := tx.Model(&ChiaBlockRecord{}).Where("id = ?", block.ID).Update("block_timestamp", block.BlockTimestamp)
+			if r.Error != nil {
+				return fmt.Errorf("error update timestamp of block %d: %v", block.Height, r.Error)
+			}
+			fixed++
+			moveFrom.AddPeriods(block.FarmerAddress, timestamp)
+			moveTo.AddPeriods(block.FarmerAddress, block.BlockTimestamp)
+		}
+		err := SubtractFarmerBlocks(moveFrom, tx)
+		if err != nil {
+			return err
+		}
+		return UpsertFarmerBlocks(moveTo, tx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return fixed, nil
+}
+
+func FixTimestampsAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb)
+	if err != nil {
+		return err
+	}
+	if config.WatchlistMode {
+		return fmt.Errorf("watchlist_mode only stores the watched blocks, fix-timestamps requires sync_blocks")
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+	toHeight := ctx.Uint64("to-height")
+	if !ctx.IsSet("to-height") {
+		syncHeight, err := GetSyncedHeight(db)
+		if err != nil {
+			return err
+		}
+		if syncHeight == nil {
+			return fmt.Errorf("no synced blocks")
+		}
+		toHeight = syncHeight.Height
+	}
+	fromHeight := ctx.Uint64("from-height")
+	if fromHeight > toHeight {
+		return fmt.Errorf("from-height %d is above to-height %d", fromHeight, toHeight)
+	}
+
+	fixed, err := FixTimestamps(db, config, fromHeight, toHeight)
+	fmt.Printf("fixed timestamps of %d blocks between height %d and %d \r\n", fixed, fromHeight, toHeight)
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// a block at height with total iters, a transaction block if timestamp is set
+func testIterBlock(height uint64, totalIters uint64, timestamp uint64) ChiaBlockRecord {
+	return ChiaBlockRecord{Height: height, TotalIters: totalIters, SubSlotIters: 600, BlockTimestamp: timestamp}
+}
+
+func TestEstimateTimestamp(t *testing.T) {
+	prev := testIterBlock(10, 1000, 100)
+	next := testIterBlock(20, 3000, 300)
+	late := testIterBlock(20, 3000, 500)
+	cases := []struct {
+		name     string
+		block    ChiaBlockRecord
+		prev     *ChiaBlockRecord
+		next     *ChiaBlockRecord
+		expected uint64
+	}{
+		{"between", testIterBlock(15, 2000, 0), &prev, &next, 200},
+		{"at previous", testIterBlock(11, 1000, 0), &prev, &next, 100},
+		{"at next", testIterBlock(19, 3000, 0), &prev, &next, 300},
+		{"after next", testIterBlock(21, 3600, 0), &prev, &next, 100 + 2600},
+		{"without next", testIterBlock(15, 2200, 0), &prev, nil, 100 + 1200},
+		{"without previous", testIterBlock(15, 2700, 0), nil, &late, 500 - 300},
+		{"before the next timestamp", testIterBlock(15, 1000, 0), nil, &next, HeightToTimestamp(15)},
+		{"without transaction blocks", testIterBlock(15, 2000, 0), nil, nil, HeightToTimestamp(15)},
+	}
+	for _, c := range cases {
+		block := c.block
+		timestamp := EstimateTimestamp(&block, c.prev, c.next)
+		if timestamp != c.expected {
+			t.Errorf("%s: timestamp %d, expected %d", c.name, timestamp, c.expected)
+		}
+	}
+}
+
+func TestInterpolateTimestamps(t *testing.T) {
+	prevTx := testIterBlock(9, 800, 80)
+	cases := []struct {
+		name        string
+		blocks      []ChiaBlockRecord
+		prevTx      *ChiaBlockRecord
+		timestamps  []uint64
+		transaction []bool
+	}{
+		{
+			"between transaction blocks",
+			[]ChiaBlockRecord{testIterBlock(10, 1000, 100), testIterBlock(11, 1500, 0), testIterBlock(12, 2000, 0), testIterBlock(13, 3000, 300)},
+			nil,
+			[]uint64{100, 150, 200, 300},
+			[]bool{true, false, false, true},
+		},
+		{
+			"leading blocks after the previous batch",
+			[]ChiaBlockRecord{testIterBlock(10, 900, 0), testIterBlock(11, 1000, 100)},
+			&prevTx,
+			[]uint64{90, 100},
+			[]bool{false, true},
+		},
+		{
+			"no transaction block",
+			[]ChiaBlockRecord{testIterBlock(10, 1400, 0), testIterBlock(11, 2000, 0)},
+			&prevTx,
+			[]uint64{80 + 600, 80 + 1200},
+			[]bool{false, false},
+		},
+		{
+			"no transaction block without a previous one",
+			[]ChiaBlockRecord{testIterBlock(10, 1400, 0), testIterBlock(11, 2000, 0)},
+			nil,
+			[]uint64{HeightToTimestamp(10), HeightToTimestamp(11)},
+			[]bool{false, false},
+		},
+	}
+	for _, c := range cases {
+		InterpolateTimestamps(c.blocks, c.prevTx)
+		for index, block := range c.blocks {
+			if block.BlockTimestamp != c.timestamps[index] || block.IsTransactionBlock != c.transaction[index] {
+				t.Errorf("%s: block %d has timestamp %d and transaction block %v, expected %d and %v", c.name, block.Height,
+					block.BlockTimestamp, block.IsTransactionBlock, c.timestamps[index], c.transaction[index])
+			}
+		}
+	}
+}
+
+func TestSplitAtLastTransactionBlock(t *testing.T) {
+	heights := func(blocks []ChiaBlockRecord) []uint64 {
+		result := []uint64{}
+		for _, block := range blocks {
+			result = append(result, block.Height)
+		}
+		return result
+	}
+	cases := []struct {
+		name   string
+		blocks []ChiaBlockRecord
+		head   []uint64
+		tail   []uint64
+	}{
+		{"ends with a transaction block", []ChiaBlockRecord{testIterBlock(1, 0, 0), testIterBlock(2, 0, 20)}, []uint64{1, 2}, []uint64{}},
+		{"carries the tail", []ChiaBlockRecord{testIterBlock(1, 0, 10), testIterBlock(2, 0, 0), testIterBlock(3, 0, 0)}, []uint64{1}, []uint64{2, 3}},
+		{"carries every block", []ChiaBlockRecord{testIterBlock(1, 0, 0), testIterBlock(2, 0, 0)}, []uint64{}, []uint64{1, 2}},
+		{"empty", nil, []uint64{}, []uint64{}},
+	}
+	for _, c := range cases {
+		head, tail := SplitAtLastTransactionBlock(c.blocks)
+		if !reflect.DeepEqual(heights(head), c.head) || !reflect.DeepEqual(heights(tail), c.tail) {
+			t.Errorf("%s: split into %v and %v, expected %v and %v", c.name, heights(head), heights(tail), c.head, c.tail)
+		}
+	}
+}
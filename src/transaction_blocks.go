@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+const CursorTransactionBlocks = "transaction_blocks"
+
+// full blocks carry the transactions generator, so a tenth of the pipelineBatch stored blocks of a batch is fetched per request
+const transactionBlocksBatch = 100
+
+// get_additions_and_removals calls in flight per batch, one call per transaction block
+const additionsAndRemovalsConcurrency = 4
+
+// details of a transaction block from its full block, linked to chia_block_records by header hash
+type ChiaTransactionBlock struct {
+	ID                       uint64    `gorm:"primaryKey;<-:false" json:"id"`
+	HeaderHash               string    `gorm:"type:varchar(256);not null;uniqueIndex:uk_tb_header_hash" json:"header_hash"`
+	Height                   uint64    `gorm:"type:bigint(20);not null;default:0;index:idx_tb_height" json:"height"`
+	BlockTimestamp           uint64    `gorm:"type:bigint(20);not null;default:0;index:idx_tb_block_timestamp" json:"timestamp"`
+	PrevTransactionBlockHash string    `gorm:"type:varchar(256);not null;default:''" json:"prev_transaction_block_hash"`
+	GeneratorRoot            string    `gorm:"type:varchar(256);not null;default:''" json:"generator_root"`
+	HasGenerator             bool      `gorm:"type:bool;not null;default:false" json:"has_generator"`
+	Fees                     uint64    `gorm:"type:bigint(20);not null;default:0" json:"fees"`
+	Cost                     uint64    `gorm:"type:bigint(20);not null;default:0" json:"cost"`
+	RewardClaims             uint64    `gorm:"type:bigint(20);not null;default:0" json:"reward_claims"`
+	RewardClaimsAmount       uint64    `gorm:"type:bigint(20);not null;default:0" json:"reward_claims_amount"`
+	Additions                uint64    `gorm:"type:bigint(20);not null;default:0" json:"additions"`
+	Removals                 uint64    `gorm:"type:bigint(20);not null;default:0" json:"removals"`
+	CreatedAt                time.Time `json:"created_at"`
+}
+
+type RewardClaim struct {
+	ParentCoinInfo string `json:"parent_coin_info"`
+	PuzzleHash     string `json:"puzzle_hash"`
+	Amount         uint64 `json:"amount"`
+}
+
+type TransactionsInfo struct {
+	GeneratorRoot            string        `json:"generator_root"`
+	Fees                     uint64        `json:"fees"`
+	Cost                     uint64        `json:"cost"`
+	RewardClaimsIncorporated []RewardClaim `json:"reward_claims_incorporated"`
+}
+
+type FoliageTransactionBlock struct {
+	PrevTransactionBlockHash string `json:"prev_transaction_block_hash"`
+	Timestamp                uint64 `json:"timestamp"`
+}
+
+// the fields of a chia full block used here, the transactions generator is not decoded
+type FullBlock struct {
+	HeaderHash       string `json:"header_hash"`
+	RewardChainBlock struct {
+		Height uint64 `json:"height"`
+	} `json:"reward_chain_block"`
+	FoliageTransactionBlock *FoliageTransactionBlock `json:"foliage_transaction_block"`
+	TransactionsInfo        *TransactionsInfo        `json:"transactions_info"`
+	TransactionsGenerator   *json.RawMessage         `json:"transactions_generator"`
+}
+
+type GetBlocksResponse struct {
+	RpcResponse
+	Blocks []FullBlock `json:"blocks"`
+}
+
+type GetAdditionsAndRemovalsResponse struct {
+	RpcResponse
+	Additions []json.RawMessage `json:"additions"`
+	Removals  []json.RawMessage `json:"removals"`
+}
+
+func NewChiaTransactionBlock(block *FullBlock) *ChiaTransactionBlock {
+	transactionBlock := &ChiaTransactionBlock{
+		HeaderHash:               block.HeaderHash,
+		Height:                   block.RewardChainBlock.Height,
+		BlockTimestamp:           block.FoliageTransactionBlock.Timestamp,
+		PrevTransactionBlockHash: block.FoliageTransactionBlock.PrevTransactionBlockHash,
+		HasGenerator:             block.TransactionsGenerator != nil && string(*block.TransactionsGenerator) != "null",
+	}
+	if block.TransactionsInfo != nil {
+		transactionBlock.GeneratorRoot = block.TransactionsInfo.GeneratorRoot
+		transactionBlock.Fees = block.TransactionsInfo.Fees
+		transactionBlock.Cost = block.TransactionsInfo.Cost
+		transactionBlock.RewardClaims = uint64(len(block.TransactionsInfo.RewardClaimsIncorporated))
+		for _, claim := range block.TransactionsInfo.RewardClaimsIncorporated {
+			transactionBlock.RewardClaimsAmount += claim.Amount
+		}
+	}
+	return transactionBlock
+}
+
+// fetch the full blocks of the stored blocks, the returned write stores the details of the transaction blocks
+// and corrects the transaction block flag of the stored blocks, which is guessed from the timestamp by sync
+func ApplyTransactionBlocks(ctx context.Context, pool *FullNodePool, blocks []ChiaBlockRecord, config *Config) (func(tx *gorm.DB) error, error) {
+	node, err := pool.Node(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start := blocks[0].Height
+	end := blocks[len(blocks)-1].Height + 1
+	result, err := node.GetBlocks(ctx, GetBlocksRequest{Start: start, End: end})
+	if err != nil {
+		return nil, err
+	}
+	// quarantined heights are not stored, their full blocks are left out
+	fullBlocks := make(map[uint64]*FullBlock)
+	for index := range result.Blocks {
+		fullBlocks[result.Blocks[index].RewardChainBlock.Height] = &result.Blocks[index]
+	}
+	var transactionBlocks []ChiaTransactionBlock
+	var corrected []ChiaBlockRecord
+	for _, stored := range blocks {
+		block, ok := fullBlocks[stored.Height]
+		if !ok {
+			return nil, fmt.Errorf("full block %d not found in %d-%d", stored.Height, start, end-1)
+		}
+		if block.HeaderHash != stored.HeaderHash {
+			return nil, fmt.Errorf("full block %d does not match the stored block, hash: %s, expect: %s",
+				stored.Height, block.HeaderHash, stored.HeaderHash)
+		}
+		isTransactionBlock := block.FoliageTransactionBlock != nil
+		if isTransactionBlock != stored.IsTransactionBlock {
+			if isTransactionBlock && stored.BlockTimestamp != block.FoliageTransactionBlock.Timestamp {
+				fmt.Printf("block %d is a transaction block of timestamp %d but stored with %d \r\n",
+					stored.Height, block.FoliageTransactionBlock.Timestamp, stored.BlockTimestamp)
+			}
+			stored.IsTransactionBlock = isTransactionBlock
+			corrected = append(corrected, stored)
+		}
+		if !isTransactionBlock {
+			continue
+		}
+		transactionBlocks = append(transactionBlocks, *NewChiaTransactionBlock(block))
+	}
+	err = countAdditionsAndRemovals(ctx, node, transactionBlocks)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(tx *gorm.DB) error {
+		for _, block := range corrected {
+			r := tx.Model(&ChiaBlockRecord{}).Where("header_hash = ?", block.HeaderHash).Update("is_transaction_block", block.IsTransactionBlock)
+			if r.Error != nil {
+				return fmt.Errorf("error correct transaction block flag of block %d: %v", block.Height, r.Error)
+			}
+		}
+		if len(transactionBlocks) == 0 {
+			return nil
+		}
+		r := tx.Create(&transactionBlocks)
+		if r.Error != nil {
+			return fmt.Errorf("error save transaction blocks: %v", r.Error)
+		}
+		return nil
+	}, nil
+}
+
+// count the coins added and removed by the transaction blocks, with at most additionsAndRemovalsConcurrency calls in flight.
+// the remaining calls are canceled after the first error.
+func countAdditionsAndRemovals(ctx context.Context, node *FullNodeClient, transactionBlocks []ChiaTransactionBlock) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tokens := make(chan struct{}, additionsAndRemovalsConcurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var first error
+	for index := range transactionBlocks {
+		tokens <- struct{}{}
+		if ctx.Err() != nil {
+			<-tokens
+			break
+		}
+		wg.Add(1)
+		go func(block *ChiaTransactionBlock) {
+			defer wg.Done()
+			defer func() { <-tokens }()
+			coins, err := node.GetAdditionsAndRemovals(ctx, GetAdditionsAndRemovalsRequest{HeaderHash: block.HeaderHash})
+			if err != nil {
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+				cancel()
+				return
+			}
+			block.Additions = uint64(len(coins.Additions))
+			block.Removals = uint64(len(coins.Removals))
+		}(&transactionBlocks[index])
+	}
+	wg.Wait()
+	if first == nil {
+		return ctx.Err()
+	}
+	return first
+}
+
+func RollbackTransactionBlocks(from uint64, config *Config, tx *gorm.DB) error {
+	r := tx.Where("height >= ?", from).Delete(&ChiaTransactionBlock{})
+	if r.Error != nil {
+		return fmt.Errorf("error delete transaction blocks: %v", r.Error)
+	}
+	return nil
+}
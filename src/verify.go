@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"gorm.io/gorm"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+const verifyBatch = 100
+
+const VerifyMissing = "missing"
+const VerifyDuplicate = "duplicate"
+const VerifyMismatch = "mismatch"
+
+// a stored block which differs from the full node
+type VerifyIssue struct {
+	Height uint64 `json:"height"`
+	Kind   string `json:"kind"`
+	Field  string `json:"field,omitempty"`
+	Stored string `json:"stored,omitempty"`
+	Node   string `json:"node,omitempty"`
+}
+
+// a farmer whose total blocks differ from the count of its stored blocks
+type FarmerTotalIssue struct {
+	FarmerAddress string `json:"farmer_address"`
+	Aggregate     uint64 `json:"aggregate"`
+	Records       uint64 `json:"records"`
+}
+
+type VerifyReport struct {
+	From          uint64             `json:"from"`
+	To            uint64             `json:"to"`
+	Checked       uint64             `json:"checked"`
+	Issues        []VerifyIssue      `json:"issues"`
+	FarmerTotals  []FarmerTotalIssue `json:"farmer_totals"`
+	RepairedSpans [][2]uint64        `json:"repaired_spans,omitempty"`
+}
+
+func (r *VerifyReport) Failed() bool {
+	return len(r.Issues) > 0 || len(r.FarmerTotals) > 0
+}
+
+// compare the stored blocks of [start, end) with the full node.
+// with checkMissing, heights without a stored block are reported.
+func VerifyRange(ctx context.Context, node *FullNodeClient, db *gorm.DB, start uint64, end uint64, checkMissing bool) ([]VerifyIssue, error) {
+	canonical, err := fetchBlockRange(ctx, node, start, end)
+	if err != nil {
+		return nil, err
+	}
+	var stored []ChiaBlockRecord
+	r := db.Where("height >= ? and height < ?", start, end).Order("height").Find(&stored)
+	if r.Error != nil {
+		return nil, fmt.Errorf("error read stored blocks: %v", r.Error)
+	}
+	byHeight := make(map[uint64][]ChiaBlockRecord, len(stored))
+	for _, block := range stored {
+		byHeight[block.Height] = append(byHeight[block.Height], block)
+	}
+	quarantined := make(map[uint64]bool)
+	if checkMissing {
+		heights, err := QuarantinedHeights(db, start, end-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, height := range heights {
+			quarantined[height] = true
+		}
+	}
+
+	var issues []VerifyIssue
+	for _, expected := range canonical {
+		blocks := byHeight[expected.Height]
+		if len(blocks) == 0 {
+			if checkMissing && !quarantined[expected.Height] {
+				issues = append(issues, VerifyIssue{Height: expected.Height, Kind: VerifyMissing})
+			}
+			continue
+		}
+		if len(blocks) > 1 {
+			issues = append(issues, VerifyIssue{Height: expected.Height, Kind: VerifyDuplicate, Stored: fmt.Sprintf("%d rows", len(blocks))})
+		}
+		for _, block := range blocks {
+			if block.HeaderHash != expected.HeaderHash {
+				issues = append(issues, VerifyIssue{Height: expected.Height, Kind: VerifyMismatch, Field: "header_hash", Stored: block.HeaderHash, Node: expected.HeaderHash})
+			}
+			if block.FarmerPuzzleHash != expected.FarmerPuzzleHash {
+				issues = append(issues, VerifyIssue{Height: expected.Height, Kind: VerifyMismatch, Field: "farmer_puzzle_hash", Stored: block.FarmerPuzzleHash, Node: expected.FarmerPuzzleHash})
+			}
+			// only transaction blocks carry a timestamp, the others are interpolated
+			if expected.BlockTimestamp != 0 && block.BlockTimestamp != expected.BlockTimestamp {
+				issues = append(issues, VerifyIssue{Height: expected.Height, Kind: VerifyMismatch, Field: "timestamp",
+					Stored: fmt.Sprintf("%d", block.BlockTimestamp), Node: fmt.Sprintf("%d", expected.BlockTimestamp)})
+			}
+		}
+	}
+	return issues, nil
+}
+
+// farmers whose ChiaTotalFarmerBlocks differ from the count of their stored blocks
+func VerifyFarmerTotals(db *gorm.DB) ([]FarmerTotalIssue, error) {
+	var totals []ChiaTotalFarmerBlocks
+	r := db.Find(&totals)
+	if r.Error != nil {
+		return nil, fmt.Errorf("error read total blocks: %v", r.Error)
+	}
+	var counted []ChiaTotalFarmerBlocks
+	r = db.Model(&ChiaBlockRecord{}).Select("farmer_address, count(*) as block_count").Group("farmer_address").Find(&counted)
+	if r.Error != nil {
+		return nil, fmt.Errorf("error count stored blocks: %v", r.Error)
+	}
+	records := make(map[string]uint64, len(counted))
+	for _, row := range counted {
+		records[row.FarmerAddress] = row.BlockCount
+	}
+	var issues []FarmerTotalIssue
+	for _, total := range totals {
+		if total.BlockCount != records[total.FarmerAddress] {
+			issues = append(issues, FarmerTotalIssue{FarmerAddress: total.FarmerAddress, Aggregate: total.BlockCount, Records: records[total.FarmerAddress]})
+		}
+		delete(records, total.FarmerAddress)
+	}
+	for farmerAddress, count := range records {
+		issues = append(issues, FarmerTotalIssue{FarmerAddress: farmerAddress, Records: count})
+	}
+	sort.Slice(issues, func(i, j int) bool { return issues[i].FarmerAddress < issues[j].FarmerAddress })
+	return issues, nil
+}
+
+// contiguous height spans covering the heights of issues
+func issueSpans(issues []VerifyIssue) [][2]uint64 {
+	heights := make([]uint64, 0, len(issues))
+	for _, issue := range issues {
+		heights = append(heights, issue.Height)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	var spans [][2]uint64
+	for _, height := range heights {
+		if len(spans) > 0 && height <= spans[len(spans)-1][1]+1 {
+			if height > spans[len(spans)-1][1] {
+				spans[len(spans)-1][1] = height
+			}
+			continue
+		}
+		spans = append(spans, [2]uint64{height, height})
+	}
+	return spans
+}
+
+// verify the stored blocks of [from, to], or sample heights of it, and the farmer totals.
+// with repair, the heights with issues are resynced and the aggregates are rebuilt if the totals still differ.
+func Verify(ctx context.Context, node *FullNodeClient, config *Config, db *gorm.DB, from uint64, to uint64, sample int, repair bool) (*VerifyReport, error) {
+	report := &VerifyReport{From: from, To: to}
+	// watchlist mode only stores the watched blocks
+	full := config.SyncBlocks
+	if sample > 0 {
+		heights := make(map[uint64]bool)
+		for len(heights) < sample && uint64(len(heights)) <= to-from {
+			heights[from+uint64(rand.Int63n(int64(to-from+1)))] = true
+		}
+		for height := range heights {
+			issues, err := VerifyRange(ctx, node, db, height, height+1, full)
+			if err != nil {
+				return nil, err
+			}
+			report.Issues = append(report.Issues, issues...)
+			report.Checked++
+		}
+	} else {
+		for start := from; start <= to; start += verifyBatch {
+			end := start + verifyBatch
+			if end > to+1 {
+				end = to + 1
+			}
+			issues, err := VerifyRange(ctx, node, db, start, end, full)
+			if err != nil {
+				return nil, err
+			}
+			report.Issues = append(report.Issues, issues...)
+			report.Checked += end - start
+		}
+	}
+	sort.SliceStable(report.Issues, func(i, j int) bool { return report.Issues[i].Height < report.Issues[j].Height })
+	if full {
+		totals, err := VerifyFarmerTotals(db)
+		if err != nil {
+			return nil, err
+		}
+		report.FarmerTotals = totals
+	}
+	if !repair || !report.Failed() {
+		return report, nil
+	}
+
+	if !full {
+		return report, fmt.Errorf("repair requires sync_blocks")
+	}
+	for _, span := range issueSpans(report.Issues) {
+		fmt.Printf("repair blocks %d-%d \r\n", span[0], span[1])
+		_, err := ResyncRange(ctx, node, config, db, span[0], span[1])
+		if err != nil {
+			return report, fmt.Errorf("error repair blocks %d-%d: %v", span[0], span[1], err)
+		}
+		report.RepairedSpans = append(report.RepairedSpans, span)
+	}
+	totals, err := VerifyFarmerTotals(db)
+	if err != nil {
+		return report, err
+	}
+	if len(totals) > 0 {
+		fmt.Printf("%d farmer totals still differ from the stored blocks, rebuild the aggregates \r\n", len(totals))
+		err = RebuildAggregates(db, config, 0, math.MaxInt64, false)
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func VerifyAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb|NeedFullNode)
+	if err != nil {
+		return err
+	}
+	if !config.SyncBlocks && !config.WatchlistMode {
+		return fmt.Errorf("no stored block records to verify, enable sync_blocks or watchlist_mode")
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+	syncHeight, err := GetSyncedHeight(db)
+	if err != nil {
+		return err
+	}
+	if syncHeight == nil {
+		return fmt.Errorf("no synced blocks")
+	}
+	from, to := ctx.Uint64("from"), syncHeight.Height
+	if ctx.IsSet("to") && ctx.Uint64("to") < to {
+		to = ctx.Uint64("to")
+	}
+	if from > to {
+		return fmt.Errorf("from %d is above to %d", from, to)
+	}
+	runCtx, stop := SignalContext()
+	defer stop()
+	pool, err := NewFullNodePool(config)
+	if err != nil {
+		return err
+	}
+	node, err := pool.Select(runCtx)
+	if err != nil {
+		return err
+	}
+
+	rand.Seed(time.Now().UnixNano())
+	report, err := Verify(runCtx, node, config, db, from, to, ctx.Int("sample"), ctx.Bool("repair"))
+	if report != nil {
+		if ctx.Bool("json") {
+			encodeErr := json.NewEncoder(os.Stdout).Encode(report)
+			if encodeErr != nil {
+				return encodeErr
+			}
+		} else {
+			printVerifyReport(report)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if report.Failed() && !ctx.Bool("repair") {
+		return fmt.Errorf("verify found %d block issues and %d farmer total issues", len(report.Issues), len(report.FarmerTotals))
+	}
+	return nil
+}
+
+func printVerifyReport(report *VerifyReport) {
+	for _, issue := range report.Issues {
+		switch issue.Kind {
+		case VerifyMismatch:
+			fmt.Printf("height %d: %s mismatch, stored: %s, node: %s \r\n", issue.Height, issue.Field, issue.Stored, issue.Node)
+		case VerifyDuplicate:
+			fmt.Printf("height %d: duplicated, %s \r\n", issue.Height, issue.Stored)
+		default:
+			fmt.Printf("height %d: %s \r\n", issue.Height, issue.Kind)
+		}
+	}
+	for _, total := range report.FarmerTotals {
+		fmt.Printf("farmer %s: total blocks %d, stored blocks %d \r\n", total.FarmerAddress, total.Aggregate, total.Records)
+	}
+	for _, span := range report.RepairedSpans {
+		fmt.Printf("repaired blocks %d-%d \r\n", span[0], span[1])
+	}
+	fmt.Printf("verified %d heights between %d and %d: %d block issues, %d farmer total issues \r\n",
+		report.Checked, report.From, report.To, len(report.Issues), len(report.FarmerTotals))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/urfave/cli"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+	"time"
+)
+
+// a watched farmer or pool address, in addition to the watchlist setting
+type ChiaWatchlist struct {
+	ID        uint64    `gorm:"primaryKey;<-:false" json:"id"`
+	Address   string    `gorm:"type:varchar(256);not null;uniqueIndex:uk_wl_address" json:"address"`
+	Note      string    `gorm:"type:varchar(256);not null;default:''" json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// a block won by a watched farmer or pool address
+type ChiaWonBlockEvent struct {
+	ID                 uint64    `gorm:"primaryKey;<-:false" json:"id"`
+	Height             uint64    `gorm:"type:bigint(20);not null;default:0;index:idx_wbe_height" json:"height"`
+	HeaderHash         string    `gorm:"type:varchar(256);not null;uniqueIndex:uk_wbe_header_hash" json:"header_hash"`
+	FarmerAddress      string    `gorm:"type:varchar(256);not null;default:'';index:idx_wbe_farmer_address" json:"farmer_address"`
+	PoolAddress        string    `gorm:"type:varchar(256);not null;default:'';index:idx_wbe_pool_address" json:"pool_address"`
+	MatchedAddress     string    `gorm:"type:varchar(256);not null;default:''" json:"matched_address"`
+	BlockTimestamp     uint64    `gorm:"type:int;not null;default:0" json:"block_timestamp"`
+	Fees               uint64    `gorm:"type:bigint(20);not null;default:0" json:"fees"`
+	IsTransactionBlock bool      `gorm:"type:bool;not null;default:false" json:"is_transaction_block"`
+	Orphaned           bool      `gorm:"type:bool;not null;default:false" json:"orphaned"`
+	CreatedAt          time.Time `gorm:"index:idx_wbe_created_at" json:"created_at"`
+}
+
+// bytes of a puzzle hash
+const puzzleHashLength = 32
+
+// address of a watchlist entry, which is either an xch address or a puzzle hash of puzzleHashLength bytes
+func NormalizeWatchAddress(entry string) (string, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if strings.HasPrefix(entry, "xch1") {
+		_, puzzleHash, err := DecodePuzzleHash(entry)
+		if err != nil {
+			return "", fmt.Errorf("invalid address %s: %v", entry, err)
+		}
+		if len(puzzleHash) != puzzleHashLength {
+			return "", fmt.Errorf("invalid address %s: puzzle hash of %d bytes, expect %d", entry, len(puzzleHash), puzzleHashLength)
+		}
+		return entry, nil
+	}
+	puzzleHash, err := hex.DecodeString(strings.TrimPrefix(entry, "0x"))
+	if err != nil {
+		return "", fmt.Errorf("invalid puzzle hash %s: %v", entry, err)
+	}
+	if len(puzzleHash) != puzzleHashLength {
+		return "", fmt.Errorf("invalid puzzle hash %s: %d bytes, expect %d", entry, len(puzzleHash), puzzleHashLength)
+	}
+	address, err := EncodePuzzleHash(entry, "xch")
+	if err != nil {
+		return "", fmt.Errorf("invalid puzzle hash %s: %v", entry, err)
+	}
+	return address, nil
+}
+
+// addresses of the watchlist setting and the chia_watchlists table
+func LoadWatchlist(config *Config, db *gorm.DB) (map[string]bool, error) {
+	watched := make(map[string]bool)
+	for _, address := range config.Watchlist {
+		watched[address] = true
+	}
+	var rows []ChiaWatchlist
+	r := db.Find(&rows)
+	if r.Error != nil {
+		return nil, fmt.Errorf("error read watchlist: %v", r.Error)
+	}
+	for _, row := range rows {
+		watched[row.Address] = true
+	}
+	return watched, nil
+}
+
+// store the records of the blocks won by watched addresses and a won block event for each of them.
+// farmer and pool addresses of blocks must be filled.
+func SaveWatchedBlocks(blocks []ChiaBlockRecord, config *Config, tx *gorm.DB) error {
+	watched, err := LoadWatchlist(config, tx)
+	if err != nil {
+		return err
+	}
+	var records []ChiaBlockRecord
+	var events []ChiaWonBlockEvent
+	for _, block := range blocks {
+		matched := ""
+		if watched[block.FarmerAddress] {
+			matched = block.FarmerAddress
+		} else if watched[block.PoolAddress] {
+			matched = block.PoolAddress
+		} else {
+			continue
+		}
+		records = append(records, block)
+		events = append(events, ChiaWonBlockEvent{
+			Height:             block.Height,
+			HeaderHash:         block.HeaderHash,
+			FarmerAddress:      block.FarmerAddress,
+			PoolAddress:        block.PoolAddress,
+			MatchedAddress:     matched,
+			BlockTimestamp:     block.BlockTimestamp,
+			Fees:               block.Fees,
+			IsTransactionBlock: block.IsTransactionBlock,
+		})
+		fmt.Printf("watched address %s won block %d \r\n", matched, block.Height)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	r := tx.Create(&records)
+	if r.Error != nil {
+		return fmt.Errorf("error save watched block records: %v", r.Error)
+	}
+	r = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&events)
+	if r.Error != nil {
+		return fmt.Errorf("error save won block events: %v", r.Error)
+	}
+	return nil
+}
+
+// after a chain reorg, delete the watched blocks above the fork point and mark their won block events orphaned
+func OrphanWatchedBlocks(fork *ChiaBlockRecord, db *gorm.DB) error {
+	var orphaned []ChiaBlockRecord
+	r := db.Where("height > ?", fork.Height).Order("height").Find(&orphaned)
+	if r.Error != nil {
+		return fmt.Errorf("error read watched blocks: %v", r.Error)
+	}
+	for _, block := range orphaned {
+		r = db.Where("id = ?", block.ID).Delete(&ChiaBlockRecord{})
+		if r.Error != nil {
+			return fmt.Errorf("error delete orphaned block: %v", r.Error)
+		}
+		r = db.Model(&ChiaWonBlockEvent{}).Where("header_hash = ?", block.HeaderHash).Update("orphaned", true)
+		if r.Error != nil {
+			return fmt.Errorf("error mark won block event orphaned: %v", r.Error)
+		}
+		fmt.Printf("watched block %d of %s was orphaned by a chain reorg \r\n", block.Height, block.FarmerAddress)
+	}
+	return nil
+}
+
+func WatchlistListAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb)
+	if err != nil {
+		return err
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+	for _, address := range config.Watchlist {
+		fmt.Printf("%s (config) \r\n", address)
+	}
+	var rows []ChiaWatchlist
+	r := db.Order("id").Find(&rows)
+	if r.Error != nil {
+		return fmt.Errorf("error read watchlist: %v", r.Error)
+	}
+	for _, row := range rows {
+		fmt.Printf("%s %s \r\n", row.Address, row.Note)
+	}
+	return nil
+}
+
+func WatchlistAddAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb)
+	if err != nil {
+		return err
+	}
+	if ctx.NArg() == 0 {
+		return fmt.Errorf("address or puzzle hash is required")
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+	for _, entry := range ctx.Args() {
+		address, err := NormalizeWatchAddress(entry)
+		if err != nil {
+			return err
+		}
+		row := ChiaWatchlist{Address: address, Note: ctx.String("note")}
+		r := db.Clauses(clause.OnConflict{DoUpdates: clause.AssignmentColumns([]string{"note"})}).Create(&row)
+		if r.Error != nil {
+			return fmt.Errorf("error add %s to watchlist: %v", address, r.Error)
+		}
+		fmt.Printf("watching %s \r\n", address)
+	}
+	return nil
+}
+
+func WatchlistRemoveAction(ctx *cli.Context) error {
+	config, err := NewConfig(ctx, NeedDb)
+	if err != nil {
+		return err
+	}
+	if ctx.NArg() == 0 {
+		return fmt.Errorf("address or puzzle hash is required")
+	}
+	db, err := GetDb(config)
+	if err != nil {
+		return err
+	}
+	for _, entry := range ctx.Args() {
+		address, err := NormalizeWatchAddress(entry)
+		if err != nil {
+			return err
+		}
+		r := db.Where("address = ?", address).Delete(&ChiaWatchlist{})
+		if r.Error != nil {
+			return fmt.Errorf("error remove %s from watchlist: %v", address, r.Error)
+		}
+		if r.RowsAffected == 0 {
+			fmt.Printf("%s is not in the watchlist table \r\n", address)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeWatchAddress(t *testing.T) {
+	address, err := EncodePuzzleHash(testFarmerPuzzleHashes[0], "xch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, err := EncodePuzzleHash("0x"+strings.Repeat("a1", 20), "xch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := EncodePuzzleHash("0x"+strings.Repeat("a1", 33), "xch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		entry    string
+		expected string
+		ok       bool
+	}{
+		{"address", address, address, true},
+		{"address with spaces", "  " + strings.ToUpper(address) + " ", address, true},
+		{"puzzle hash", testFarmerPuzzleHashes[0], address, true},
+		{"puzzle hash without prefix", strings.TrimPrefix(testFarmerPuzzleHashes[0], "0x"), address, true},
+		{"address of 20 bytes", short, "", false},
+		{"address of 33 bytes", long, "", false},
+		{"address with a bad checksum", address[:len(address)-1] + "q", "", false},
+		{"puzzle hash of 31 bytes", "0x" + strings.Repeat("a1", 31), "", false},
+		{"puzzle hash of 33 bytes", "0x" + strings.Repeat("a1", 33), "", false},
+		{"not hex", "0x" + strings.Repeat("zz", 32), "", false},
+		{"empty", "", "", false},
+	}
+	for _, c := range cases {
+		normalized, err := NormalizeWatchAddress(c.entry)
+		if (err == nil) != c.ok || normalized != c.expected {
+			t.Errorf("%s: got %q %v, expected %q and ok %v", c.name, normalized, err, c.expected, c.ok)
+		}
+	}
+}